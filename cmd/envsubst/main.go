@@ -19,6 +19,8 @@ var (
 	noEmpty   = flag.Bool("no-empty", false, "")
 	keepUnset = flag.Bool("keep-unset", false, "")
 	failFast  = flag.Bool("fail-fast", false, "")
+	gnu       = flag.Bool("gnu", false, "")
+	variables = flag.Bool("variables", false, "")
 )
 
 var usage = `Usage: envsubst [options...] <input>
@@ -31,6 +33,8 @@ Options:
   -no-empty  Fail if a variable is set but empty.
   -keep-unset Keep undefined variables as their original text instead of substituting them.
   -fail-fast Fail on first error otherwise display all failures if restrictions are set.
+  -gnu       Behave like GNU envsubst, only $VAR and ${VAR} are substituted.
+  -variables Print the names of the variables referenced in the input, one per line.
 `
 
 func main() {
@@ -83,9 +87,18 @@ func main() {
 	if *failFast {
 		parserMode = parse.Quick
 	}
-	restrictions := &parse.Restrictions{NoUnset: *noUnset, NoEmpty: *noEmpty, NoDigit: *noDigit, KeepUnset: *keepUnset, VarMatcher: nil}
-	result, err := (&parse.Parser{Name: "string", Env: parse.NewEnv(os.Environ()), Restrict: restrictions, Mode: parserMode}).Parse(data)
-	if err != nil {
+	restrictions := &parse.Restrictions{NoUnset: *noUnset, NoEmpty: *noEmpty, NoDigit: *noDigit, KeepUnset: *keepUnset, VarMatcher: nil, GNUCompat: *gnu}
+	parser := &parse.Parser{Name: "string", Env: parse.NewEnv(os.Environ()), Restrict: restrictions, Mode: parserMode}
+	var result string
+	if *variables {
+		names, err := parser.Variables(data)
+		if err != nil {
+			errorAndExit(err)
+		}
+		for _, name := range names {
+			result += name + "\n"
+		}
+	} else if result, err = parser.Parse(data); err != nil {
 		errorAndExit(err)
 	}
 	if _, err := file.WriteString(result); err != nil {
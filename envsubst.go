@@ -1,7 +1,16 @@
 package envsubst
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/allex/envsubst/parse"
 )
@@ -61,6 +70,75 @@ func BytesRestrictedKeepUnset(b []byte, noUnset, noEmpty bool, noDigit bool, kee
 	return []byte(s), nil
 }
 
+// StringOverride returns the parsed template string like String, with the
+// restrictions r, against the process environment with the given overrides on
+// top. The overrides win over the process environment, which is not modified.
+func StringOverride(s string, overrides map[string]string, r *parse.Restrictions) (string, error) {
+	env := parse.NewEnv(os.Environ())
+	for key, value := range overrides {
+		env.Set(key, value)
+	}
+	return parse.New("string", env, r).Parse(s)
+}
+
+// RequiredEnv returns the sorted names of the variables text needs to render
+// without error, as they are referenced without default, and of the optional
+// ones, e.g. to generate a .env.example. See parse.Parser.RequiredVariables.
+func RequiredEnv(text string, r *parse.Restrictions) (required, optional []string, err error) {
+	return parse.New("required", parse.NewEnv(nil), r).RequiredVariables(text)
+}
+
+// StringWithReport returns the parsed template string like String, with the
+// restrictions r, along with a report of how its variables resolved, e.g. for a
+// summary line in deploy logs.
+func StringWithReport(s string, r *parse.Restrictions) (string, parse.Report, error) {
+	return parse.New("string", parse.NewEnv(os.Environ()), r).ParseWithReport(s)
+}
+
+// BytesWithReport is like StringWithReport for bytes.
+func BytesWithReport(b []byte, r *parse.Restrictions) ([]byte, parse.Report, error) {
+	s, report, err := parse.New("bytes", parse.NewEnv(os.Environ()), r).ParseWithReport(string(b))
+	if err != nil {
+		return nil, report, err
+	}
+	return []byte(s), report, nil
+}
+
+// StringJSON substitutes s against the process environment with the restrictions
+// r, then unmarshals the result as JSON into v. A substitution error is returned
+// as it is, a JSON error is wrapped with its line and column in the rendered text.
+func StringJSON(s string, v interface{}, r *parse.Restrictions) error {
+	out, err := parse.New("json", parse.NewEnv(os.Environ()), r).Parse(s)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(out), v); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) && syntaxErr.Offset > 0 {
+			line, col := parse.LineColumn(out, parse.Pos(syntaxErr.Offset-1))
+			return fmt.Errorf("rendered JSON: line %d, column %d: %w", line, col, err)
+		}
+		return fmt.Errorf("rendered JSON: %w", err)
+	}
+	return nil
+}
+
+// BytesNUL substitutes each of the NUL separated records of b on its own against
+// the process environment, and joins the results with NUL again. A substitution
+// cannot span records, values containing newlines are kept intact.
+func BytesNUL(b []byte, r *parse.Restrictions) ([]byte, error) {
+	p := parse.New("bytes", parse.NewEnv(os.Environ()), r)
+	records := bytes.Split(b, []byte{0})
+	for i, record := range records {
+		s, err := p.Parse(string(record))
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i, err)
+		}
+		records[i] = []byte(s)
+	}
+	return bytes.Join(records, []byte{0}), nil
+}
+
 // ReadFile call io.ReadFile with the given file name.
 // If the call to io.ReadFile failed it returns the error; otherwise it will
 // call envsubst.Bytes with the returned content.
@@ -89,3 +167,199 @@ func ReadFileRestrictedKeepUnset(filename string, noUnset, noEmpty bool, noDigit
 	}
 	return BytesRestrictedKeepUnset(b, noUnset, noEmpty, noDigit, keepUnset)
 }
+
+// Escape returns s with every '$' doubled, so that substituting the result yields s
+// unchanged: String(Escape(s)) == s. It is meant for embedding literal text in
+// generated templates.
+func Escape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// Render substitutes text against env with the restrictions r. Each call uses its
+// own parser, so Render may be called concurrently with a shared env and r as
+// long as neither is modified meanwhile.
+func Render(text string, env *parse.Env, r *parse.Restrictions) (string, error) {
+	return parse.New("render", env, r).Parse(text)
+}
+
+// NewReader returns a reader substituting the text read from src against env with
+// the restrictions r as it is read. The input is processed line by line, which is
+// safe as a substitution cannot span lines; the TrailingNewline policy of r applies
+// to the end of the whole output. Postprocess and OutputFilters need the whole
+// output, when r has any the input is read and substituted at once. The assignments
+// of the := and = operators are seen by the following lines, as with Render, env
+// itself is not modified. The first error is returned by every subsequent Read.
+func NewReader(src io.Reader, env *parse.Env, r *parse.Restrictions) io.Reader {
+	if r == nil {
+		r = &parse.Restrictions{}
+	}
+	rd := &reader{src: bufio.NewReader(src), whole: r.Postprocess != nil || len(r.OutputFilters) > 0}
+	if !rd.whole {
+		// the newline policy is applied by the reader, not to every line
+		lines := *r
+		lines.TrailingNewline, rd.policy = parse.NewlineKeep, r.TrailingNewline
+		r = &lines
+	}
+	rd.parser = parse.New("reader", env.Clone(), r)
+	return rd
+}
+
+type reader struct {
+	src    *bufio.Reader
+	parser *parse.Parser
+	whole  bool                // substitute the whole input at once
+	policy parse.NewlinePolicy // TrailingNewline of the restrictions
+	held   int                 // trailing newlines held back under NewlineStrip
+	last   byte                // last byte of the output so far, for NewlineEnsure
+	buf    []byte              // rendered text not read yet
+	err    error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.whole {
+			b, err := io.ReadAll(r.src)
+			if err == nil {
+				var s string
+				if s, err = r.parser.Parse(string(b)); err == nil {
+					r.buf, err = []byte(s), io.EOF
+				}
+			}
+			r.err = err
+			continue
+		}
+		line, err := r.src.ReadString('\n')
+		var s string
+		if line != "" {
+			var perr error
+			if s, perr = r.parser.ParseAssign(line); perr != nil {
+				r.err = perr
+				return 0, perr
+			}
+		}
+		r.buf = []byte(r.newline(s, err == io.EOF))
+		r.err = err
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// newline applies the TrailingNewline policy to the output s of a line, as if to
+// the whole output: under NewlineStrip its trailing newlines are held back until
+// more text follows, and at the end of the input a newline is added if needed.
+func (r *reader) newline(s string, end bool) string {
+	if r.policy == parse.NewlineStrip {
+		trimmed := strings.TrimRight(s, "\n")
+		if trimmed != "" {
+			trimmed = strings.Repeat("\n", r.held) + trimmed
+			r.held = 0
+		}
+		r.held += len(s) - len(strings.TrimRight(s, "\n"))
+		s = trimmed
+	}
+	if s != "" {
+		r.last = s[len(s)-1]
+	}
+	if end && (r.held > 0 || r.policy == parse.NewlineEnsure && r.last != '\n') {
+		s += "\n"
+		r.held, r.last = 0, '\n'
+	}
+	return s
+}
+
+// RenderErrors maps template names to the error their rendering failed with.
+type RenderErrors map[string]error
+
+// Error lists the failures sorted by template name, one per line.
+func (e RenderErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(name + ": " + e[name].Error())
+	}
+	return b.String()
+}
+
+// RenderAll renders each of the named templates against the same env and restrictions.
+// It returns the outputs of the templates that rendered successfully, and if any failed
+// a RenderErrors keyed by template name.
+func RenderAll(templates map[string]string, env *parse.Env, r *parse.Restrictions) (map[string]string, error) {
+	out := make(map[string]string, len(templates))
+	errs := make(RenderErrors)
+	for name, text := range templates {
+		s, err := parse.New(name, env, r).Parse(text)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		out[name] = s
+	}
+	if len(errs) > 0 {
+		return out, errs
+	}
+	return out, nil
+}
+
+// RenderFile substitutes the content of the file src against the process
+// environment with the restrictions r and writes the result to dst, creating or
+// truncating it. dst is not written if the substitution fails.
+func RenderFile(src, dst string, r *parse.Restrictions) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	s, err := parse.New(src, parse.NewEnv(os.Environ()), r).Parse(string(b))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte(s), 0o644)
+}
+
+// ProcessManifest renders the files listed in the manifest at manifestPath with
+// RenderFile. Each line of the manifest holds a source and a destination path
+// separated by white space; blank lines and lines starting with '#' are skipped.
+// Relative paths are resolved against the directory of the manifest. All entries
+// are processed, failures are returned as a RenderErrors keyed by source path.
+func ProcessManifest(manifestPath string, r *parse.Restrictions) error {
+	b, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(manifestPath)
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	errs := make(RenderErrors)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"src dst\", got %q", manifestPath, i+1, line)
+		}
+		src := resolve(fields[0])
+		if err := RenderFile(src, resolve(fields[1]), r); err != nil {
+			errs[src] = err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
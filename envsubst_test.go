@@ -1,8 +1,18 @@
 package envsubst
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 
 	"github.com/allex/envsubst/parse"
 )
@@ -30,6 +40,80 @@ func TestIntegration(t *testing.T) {
 	}
 }
 
+func TestStringOverride(t *testing.T) {
+	t.Setenv("ENVSUBST_TEST_AMBIENT", "ambient")
+	t.Setenv("ENVSUBST_TEST_SHADOWED", "process")
+	overrides := map[string]string{"ENVSUBST_TEST_SHADOWED": "override", "ENVSUBST_TEST_NEW": "new"}
+
+	input := "$ENVSUBST_TEST_AMBIENT $ENVSUBST_TEST_SHADOWED $ENVSUBST_TEST_NEW"
+	str, err := StringOverride(input, overrides, &parse.Restrictions{NoUnset: true})
+	if expected := "ambient override new"; err != nil || str != expected {
+		t.Errorf("Expected %q, got %q, %v", expected, str, err)
+	}
+	if v := os.Getenv("ENVSUBST_TEST_SHADOWED"); v != "process" {
+		t.Errorf("Expected the process environment to be untouched, got %q", v)
+	}
+	if _, ok := os.LookupEnv("ENVSUBST_TEST_NEW"); ok {
+		t.Error("Expected the override not to be added to the process environment")
+	}
+
+	str, err = StringOverride("${ENVSUBST_TEST_SHADOWED}", nil, nil)
+	if err != nil || str != "process" {
+		t.Errorf("Expected the process value without overrides, got %q, %v", str, err)
+	}
+	if _, err := StringOverride("$ENVSUBST_TEST_NOTSET", overrides, &parse.Restrictions{NoUnset: true}); err == nil {
+		t.Error("Expected restrictions to apply")
+	}
+}
+
+func TestRequiredEnv(t *testing.T) {
+	input := "DB_HOST=$DB_HOST\nDB_PORT=${DB_PORT:-5432}\nDB_USER=${DB_USER}\nDB_PASSWORD=${DB_PASSWORD:-$DB_USER}\n"
+	required, optional, err := RequiredEnv(input, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"DB_HOST", "DB_USER"}; !reflect.DeepEqual(required, expected) {
+		t.Errorf("Expected required %q, got %q", expected, required)
+	}
+	if expected := []string{"DB_PASSWORD", "DB_PORT"}; !reflect.DeepEqual(optional, expected) {
+		t.Errorf("Expected optional %q, got %q", expected, optional)
+	}
+}
+
+func TestStringWithReport(t *testing.T) {
+	input := "$BAR ${ENVSUBST_NOTSET:-x} $ENVSUBST_NOTSET"
+	out, report, err := StringWithReport(input, &parse.Restrictions{KeepUnset: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "bar x $ENVSUBST_NOTSET"; out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+	if expected := "rendered: 1 resolved, 1 defaulted, 1 kept"; report.String() != expected {
+		t.Errorf("Expected report %q, got %q", expected, report)
+	}
+
+	b, report, err := BytesWithReport([]byte(input), &parse.Restrictions{})
+	if err != nil || string(b) != "bar x " {
+		t.Errorf("Unexpected output %q, %v", b, err)
+	}
+	if report != (parse.Report{Resolved: 1, Defaulted: 1, Unset: 1}) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+func TestBytesLatin1(t *testing.T) {
+	input := []byte("r\xe9sum\xe9: $BAR\n\xa9 ${BAR} \xff\n")
+	expected := []byte("r\xe9sum\xe9: bar\n\xa9 bar \xff\n")
+	out, err := Bytes(input)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
 func TestKeepUnsetIntegration(t *testing.T) {
 	// Test that undefined variables are kept as original text
 	input := "foo $UNDEFINED_VAR ${ALSO_UNDEFINED} $BAR"
@@ -127,3 +211,292 @@ func TestEnvInitializeAndLazyInjection(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderAll(t *testing.T) {
+	env := parse.NewEnv([]string{"NAME=web", "PORT=8080"})
+	templates := map[string]string{
+		"deployment.yaml": "name: $NAME\nport: ${PORT}",
+		"service.yaml":    "name: $NAME\nhost: ${HOST}",
+	}
+
+	out, err := RenderAll(templates, env, &parse.Restrictions{NoUnset: true})
+	if err == nil {
+		t.Fatal("expected an error for service.yaml")
+	}
+	var renderErrs RenderErrors
+	if !errors.As(err, &renderErrs) {
+		t.Fatalf("expected RenderErrors, got %T", err)
+	}
+	if len(renderErrs) != 1 || renderErrs["service.yaml"] == nil {
+		t.Errorf("expected a single error for service.yaml, got %v", renderErrs)
+	}
+	if expected := "service.yaml: variable ${HOST} not set"; err.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, err.Error())
+	}
+	if expected := "name: web\nport: 8080"; out["deployment.yaml"] != expected {
+		t.Errorf("Expected %q, got %q", expected, out["deployment.yaml"])
+	}
+	if _, ok := out["service.yaml"]; ok {
+		t.Error("failed template should not have an output")
+	}
+
+	out, err = RenderAll(templates, env, &parse.Restrictions{})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(out) != 2 || out["service.yaml"] != "name: web\nhost: " {
+		t.Errorf("Unexpected outputs: %q", out)
+	}
+}
+
+func TestProcessManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.tmpl":  "bar is $BAR\n",
+		"db.tmpl":   "host is ${ENVSUBST_TEST_NOTSET}\n",
+		"manifest":  "# templates\napp.tmpl app.conf\n\ndb.tmpl  db.conf\n",
+		"malformed": "app.tmpl\n",
+		"db.conf":   "previous\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := ProcessManifest(filepath.Join(dir, "manifest"), &parse.Restrictions{NoUnset: true})
+	var renderErrs RenderErrors
+	if !errors.As(err, &renderErrs) {
+		t.Fatalf("expected RenderErrors, got %T: %v", err, err)
+	}
+	src := filepath.Join(dir, "db.tmpl")
+	if len(renderErrs) != 1 || renderErrs[src] == nil {
+		t.Errorf("expected a single error for %s, got %v", src, renderErrs)
+	}
+	if expected := src + ": variable ${ENVSUBST_TEST_NOTSET} not set"; err.Error() != expected {
+		t.Errorf("Expected error %q, got %q", expected, err.Error())
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "app.conf")); err != nil || string(b) != "bar is bar\n" {
+		t.Errorf("Expected app.conf to be rendered, got %q, %v", b, err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "db.conf")); string(b) != "previous\n" {
+		t.Errorf("failed entry should not overwrite db.conf, got %q", b)
+	}
+
+	if err := ProcessManifest(filepath.Join(dir, "manifest"), &parse.Restrictions{}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "db.conf")); string(b) != "host is \n" {
+		t.Errorf("Expected db.conf to be rendered, got %q", b)
+	}
+
+	err = ProcessManifest(filepath.Join(dir, "malformed"), nil)
+	if err == nil || !strings.Contains(err.Error(), "malformed:1") {
+		t.Errorf("Expected an error pointing at the malformed line, got %v", err)
+	}
+	if err := ProcessManifest(filepath.Join(dir, "missing"), nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+}
+
+func TestStringJSON(t *testing.T) {
+	t.Setenv("ENVSUBST_TEST_PORT", "8080")
+
+	type config struct {
+		Name  string   `json:"name"`
+		Port  int      `json:"port"`
+		Hosts []string `json:"hosts"`
+	}
+	var c config
+	input := `{"name": "$BAR", "port": $ENVSUBST_TEST_PORT, "hosts": ["${ENVSUBST_TEST_HOST:-localhost}"]}`
+	if err := StringJSON(input, &c, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := (config{"bar", 8080, []string{"localhost"}}); !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, c)
+	}
+
+	err := StringJSON(`{"port": ${ENVSUBST_TEST_NOTSET}}`, &c, &parse.Restrictions{NoUnset: true})
+	if err == nil || err.Error() != "variable ${ENVSUBST_TEST_NOTSET} not set" {
+		t.Errorf("Expected the substitution error, got %v", err)
+	}
+
+	err = StringJSON("{\n  \"port\": $ENVSUBST_TEST_NOTSET\n}", &c, nil)
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("Expected a wrapped *json.SyntaxError, got %T: %v", err, err)
+	}
+	if !strings.HasPrefix(err.Error(), "rendered JSON: line 3, column 1: ") {
+		t.Errorf("Expected the position of the JSON error, got %q", err.Error())
+	}
+
+	err = StringJSON(`{"port": "$ENVSUBST_TEST_PORT"}`, &c, nil)
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) || !strings.HasPrefix(err.Error(), "rendered JSON: ") {
+		t.Errorf("Expected a wrapped *json.UnmarshalTypeError, got %v", err)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	inputs := []string{
+		"",
+		"plain text",
+		"foo $BAR baz",
+		"${BAR} and ${NOTSET:-default}",
+		"cost $",
+		"$$ and $$$BAR",
+		"$ {BAR} $}",
+		"nested ${A:-${B}} $1",
+	}
+	for _, input := range inputs {
+		escaped := Escape(input)
+		out, err := String(escaped)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", input, err)
+			continue
+		}
+		if out != input {
+			t.Errorf("round trip of %q through %q: got %q", input, escaped, out)
+		}
+	}
+}
+
+func TestRenderConcurrent(t *testing.T) {
+	env := parse.NewEnv([]string{"NAME=web", "PORT=8080"})
+	r := &parse.Restrictions{NoUnset: true}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			text := fmt.Sprintf("%d: ${NAME^^}:$PORT ${ID:-%d}", i, i)
+			out, err := Render(text, env, r)
+			if expected := fmt.Sprintf("%d: WEB:8080 %d", i, i); err != nil || out != expected {
+				errs <- fmt.Errorf("expected %q, got %q, %v", expected, out, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if _, err := Render("$MISSING", env, r); err == nil {
+		t.Error("expected NoUnset error")
+	}
+}
+
+func TestBytesNUL(t *testing.T) {
+	input := []byte("/tmp/$BAR\x00/srv/${BAR}/a\nb\x00plain\x00")
+	expected := []byte("/tmp/bar\x00/srv/bar/a\nb\x00plain\x00")
+	out, err := BytesNUL(input, &parse.Restrictions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+
+	// a substitution does not continue into the next record
+	if _, err := BytesNUL([]byte("${BAR\x00}"), &parse.Restrictions{}); err == nil {
+		t.Error("expected an error for a substitution spanning records")
+	}
+	_, err = BytesNUL([]byte("$BAR\x00$ENVSUBST_NOTSET"), &parse.Restrictions{NoUnset: true})
+	if expected := "record 1: variable ${ENVSUBST_NOTSET} not set"; err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v", expected, err)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	env := parse.NewEnv([]string{"NAME=web", "PORT=8080", "LONG=" + strings.Repeat("x", 100)})
+	input := "name: ${NAME}\nport: $PORT\n\nlong: ${LONG}\nprice: $$5 ${NOTSET:-none}"
+	expected := "name: web\nport: 8080\n\nlong: " + strings.Repeat("x", 100) + "\nprice: $5 none"
+
+	// variables span the reads of the source, the output is read in small chunks
+	rd := NewReader(iotest.OneByteReader(strings.NewReader(input)), env, &parse.Restrictions{})
+	var out []byte
+	chunk := make([]byte, 3)
+	for {
+		n, err := rd.Read(chunk)
+		out = append(out, chunk[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+
+	rd = NewReader(strings.NewReader("ok: $NAME\nbad: $NOTSET\n"), env, &parse.Restrictions{NoUnset: true})
+	out, err := io.ReadAll(rd)
+	if err == nil {
+		t.Fatal("expected NoUnset error")
+	}
+	if string(out) != "ok: web\n" {
+		t.Errorf("expected the lines before the error, got %q", out)
+	}
+	if _, again := rd.Read(chunk); again != err {
+		t.Errorf("expected the error to be sticky, got %v", again)
+	}
+	// assignments carry over to the following lines, as with Render
+	input = "${Z:=5}\n[$Z]\n${W=$Z}$W\n"
+	expected, err = Render(input, env, &parse.Restrictions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err = io.ReadAll(NewReader(strings.NewReader(input), env, &parse.Restrictions{})); err != nil || string(out) != expected {
+		t.Errorf("expected %q like Render, got %q, %v", expected, out, err)
+	}
+	if expected != "5\n[5]\n55\n" || env.Has("Z") {
+		t.Errorf("expected the env to be left untouched, got %q", expected)
+	}
+	// nil restrictions, as with Render
+	if out, err = io.ReadAll(NewReader(strings.NewReader("name: $NAME\n"), env, nil)); err != nil || string(out) != "name: web\n" {
+		t.Errorf("expected %q, got %q, %v", "name: web\n", out, err)
+	}
+}
+
+// TestNewReaderOutput verifies that the output options apply to the whole output
+// of NewReader, as with Render, not to each line
+func TestNewReaderOutput(t *testing.T) {
+	env := parse.NewEnv([]string{"NAME=web"})
+	upper := func(s string) (string, error) { return strings.ToUpper(s), nil }
+	count := func(b []byte) ([]byte, error) { return fmt.Appendf(b, "%d lines", bytes.Count(b, []byte("\n"))), nil }
+
+	tests := []struct {
+		name, input string
+		restrict    *parse.Restrictions
+	}{
+		{"strip", "a\n\n\n", &parse.Restrictions{TrailingNewline: parse.NewlineStrip}},
+		{"strip blank lines kept", "a\n\n$NAME\n\n", &parse.Restrictions{TrailingNewline: parse.NewlineStrip}},
+		{"strip without newline", "a\nb", &parse.Restrictions{TrailingNewline: parse.NewlineStrip}},
+		{"strip only newlines", "\n\n", &parse.Restrictions{TrailingNewline: parse.NewlineStrip}},
+		{"ensure", "a\n$NAME", &parse.Restrictions{TrailingNewline: parse.NewlineEnsure}},
+		{"ensure present", "a\n$NAME\n", &parse.Restrictions{TrailingNewline: parse.NewlineEnsure}},
+		{"ensure empty", "", &parse.Restrictions{TrailingNewline: parse.NewlineEnsure}},
+		{"postprocess", "a\n$NAME\n\n", &parse.Restrictions{TrailingNewline: parse.NewlineStrip, Postprocess: upper}},
+		{"output filter", "a\n$NAME\n", &parse.Restrictions{OutputFilters: []func([]byte) ([]byte, error){count}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, err := Render(tt.input, env, tt.restrict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(NewReader(iotest.OneByteReader(strings.NewReader(tt.input)), env, tt.restrict))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(out) != expected {
+				t.Errorf("Expected %q like Render, got %q", expected, out)
+			}
+		})
+	}
+}
@@ -1,5 +1,21 @@
 package parse
 
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Resolver is a source of variables, such as an Env, a secret store or a
+// configuration file. Has reports whether the key is set, Get returns its value.
+type Resolver interface {
+	Has(key string) bool
+	Get(key string) string
+}
+
 // Env represents a collection of environment variables with efficient lookup capabilities.
 // It maintains environment variables in "KEY=VALUE" format and provides an indexed
 // mapping for fast retrieval. Duplicate keys are handled by keeping only the first
@@ -7,6 +23,25 @@ package parse
 type Env struct {
 	env     []string
 	indexes map[string]int
+	lookup  func(key string) (string, bool) // optional fallback for keys not in env
+	access  *accessLog                      // records the keys read, set by NewStrictEnv
+}
+
+// accessLog records the keys read from a strict Env, see NewStrictEnv.
+type accessLog struct {
+	mu       sync.Mutex
+	declared map[string]bool
+	keys     map[string]bool
+}
+
+// record notes that key was read.
+func (a *accessLog) record(key string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.keys[key] = true
+	a.mu.Unlock()
 }
 
 // NewEnv creates a new Env instance from a slice of environment variable strings.
@@ -18,23 +53,130 @@ type Env struct {
 //	env := NewEnv([]string{"HOME=/home/user", "PATH=/usr/bin", "HOME=/duplicate"})
 //	// The second HOME entry will be ignored
 func NewEnv(env []string) *Env {
+	return NewEnvWithPolicy(env, false)
+}
+
+// NewEnvWithPolicy creates a new Env like NewEnv, with a choice of the duplicate
+// key policy: if lastWins is true the last occurrence of a key is kept instead of
+// the first, as when overrides are appended to os.Environ().
+//
+// Example:
+//
+//	env := NewEnvWithPolicy(append(os.Environ(), "HOME=/tmp"), true)
+//	env.Get("HOME") // Returns "/tmp"
+func NewEnvWithPolicy(env []string, lastWins bool) *Env {
 	e := &Env{env: env}
-	e.init()
+	e.init(lastWins)
+	return e
+}
+
+// OSEnv creates a new Env reading the process environment lazily: every lookup
+// calls os.LookupEnv, so changes made with os.Setenv after construction are seen.
+// Set only affects the returned Env, never the process environment.
+//
+// Example:
+//
+//	env := OSEnv()
+//	os.Setenv("LATE", "1")
+//	env.Get("LATE") // Returns "1"
+func OSEnv() *Env {
+	return NewEnvOverlay(nil)
+}
+
+// NewEnvOverlay creates a new Env whose variables are the given overrides on top
+// of the process environment. Keys missing from the overrides are looked up lazily
+// with os.LookupEnv, the process environment is never copied up front.
+// Strings only reports the overrides and variables added with Set.
+//
+// Example:
+//
+//	env := NewEnvOverlay(map[string]string{"HOME": "/tmp"})
+//	env.Get("HOME") // Returns "/tmp"
+//	env.Get("PATH") // Returns os.Getenv("PATH")
+func NewEnvOverlay(overrides map[string]string) *Env {
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, len(keys))
+	for i, k := range keys {
+		env[i] = k + "=" + overrides[k]
+	}
+	e := NewEnv(env)
+	e.lookup = os.LookupEnv
 	return e
 }
 
+// NewStrictEnv creates a new Env holding exactly the given variables, meant for
+// unit tests of templates: every key read with Get or Has is recorded, so a test
+// can check with AccessedKeys what a template reads and with CheckUndeclared that
+// it reads no variable besides the declared ones. Clones share the record, so the
+// keys read through ParseWithEnv count too.
+//
+// Example:
+//
+//	env := NewStrictEnv(map[string]string{"HOST": "localhost"})
+//	New("test", env, nil).Parse("$HOST:${PORT:-80}")
+//	env.AccessedKeys()    // Returns []string{"HOST", "PORT"}
+//	env.CheckUndeclared() // Returns an error naming PORT
+func NewStrictEnv(vars map[string]string) *Env {
+	e := NewEnvOverlay(vars)
+	e.lookup = nil
+	e.access = &accessLog{declared: make(map[string]bool, len(vars)), keys: make(map[string]bool)}
+	for k := range vars {
+		e.access.declared[k] = true
+	}
+	return e
+}
+
+// AccessedKeys returns the sorted keys read from an Env created by NewStrictEnv,
+// whether they are set or not. It returns nil for other Envs.
+func (e *Env) AccessedKeys() []string {
+	if e.access == nil {
+		return nil
+	}
+	e.access.mu.Lock()
+	defer e.access.mu.Unlock()
+	keys := make([]string, 0, len(e.access.keys))
+	for k := range e.access.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CheckUndeclared returns an error with the code "Undeclared" naming the keys read
+// from an Env created by NewStrictEnv that were not among the declared variables.
+// It returns nil if there are none, and for other Envs.
+func (e *Env) CheckUndeclared() error {
+	var undeclared []string
+	for _, k := range e.AccessedKeys() {
+		if !e.access.declared[k] {
+			undeclared = append(undeclared, k)
+		}
+	}
+	if len(undeclared) == 0 {
+		return nil
+	}
+	return Error("undeclared variables read: "+strings.Join(undeclared, ", "), "Undeclared")
+}
+
 // init initializes the Env instance by building an index map for efficient lookups.
 // It processes all environment strings, extracts keys, and handles duplicates by
-// keeping only the first occurrence of each key.
-func (e *Env) init() {
+// keeping only the first occurrence of each key, or the last one if lastWins is set.
+func (e *Env) init(lastWins bool) {
 	envs := e.env
 	indexes := make(map[string]int)
 	for i, s := range envs {
 		for j := 0; j < len(s); j++ {
 			if s[j] == '=' {
 				key := s[:j]
-				if _, ok := indexes[key]; !ok {
+				if prev, ok := indexes[key]; !ok {
 					indexes[key] = i // first mention of key
+				} else if lastWins {
+					envs[prev] = ""
+					indexes[key] = i
 				} else {
 					envs[i] = ""
 				}
@@ -54,9 +196,14 @@ func (e *Env) init() {
 //	value := env.Get("HOME")  // Returns "/home/user" for "HOME=/home/user"
 //	missing := env.Get("MISSING")  // Returns ""
 func (e *Env) Get(key string) string {
+	e.access.record(key)
 	env := e.indexes
 	i, ok := env[key]
 	if !ok {
+		if e.lookup != nil {
+			value, _ := e.lookup(key)
+			return value
+		}
 		return ""
 	}
 	s := e.env[i]
@@ -77,9 +224,14 @@ func (e *Env) Get(key string) string {
 //	exists := env.Has("HOME")    // Returns true if HOME is set
 //	missing := env.Has("MISSING") // Returns false if MISSING is not set
 func (e *Env) Has(key string) bool {
+	e.access.record(key)
 	if _, ok := e.indexes[key]; ok {
 		return ok
 	}
+	if e.lookup != nil {
+		_, ok := e.lookup(key)
+		return ok
+	}
 	return false
 }
 
@@ -104,6 +256,31 @@ func (e *Env) Set(key, value string) {
 	}
 }
 
+// SetChecked is like Set but returns an error instead of setting a key that is
+// not a valid variable name, see IsValidName.
+//
+// Example:
+//
+//	err := env.SetChecked("1VAR", "value") // Returns an error, env is unchanged
+func (e *Env) SetChecked(key, value string) error {
+	if !IsValidName(key) {
+		return Error(fmt.Sprintf("invalid variable name %q", key), "InvalidName")
+	}
+	e.Set(key, value)
+	return nil
+}
+
+// IsValidName reports whether name can be referenced as a variable with the
+// default lexing rules: letters, digits and underscores, not starting with a digit.
+func IsValidName(name string) bool {
+	for i, r := range name {
+		if !isAlphaNumeric(r) || (i == 0 && unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
 // Strings returns all environment variables as a slice of "KEY=VALUE" strings.
 // Empty entries (created during duplicate handling) are filtered out.
 // The returned slice contains all currently active environment variables.
@@ -119,3 +296,36 @@ func (e *Env) Strings() []string {
 	}
 	return result
 }
+
+// GetAll returns a snapshot of all environment variables as a map from key to value.
+// Like Strings, it only reports the variables held by the Env itself, keys that would
+// be looked up lazily from the process environment are not included.
+//
+// Example:
+//
+//	env.Set("NEW_VAR", "value")
+//	vars := env.GetAll() // vars["NEW_VAR"] == "value"
+func (e *Env) GetAll() map[string]string {
+	result := make(map[string]string, len(e.indexes))
+	for key := range e.indexes {
+		result[key] = e.Get(key)
+	}
+	return result
+}
+
+// Clone returns an independent copy of the Env with its own backing slice and
+// index map, so that Set on the clone does not affect the original and vice versa.
+//
+// Example:
+//
+//	reqEnv := env.Clone()
+//	reqEnv.Set("REQUEST_ID", id) // env is left untouched
+func (e *Env) Clone() *Env {
+	env := make([]string, len(e.env))
+	copy(env, e.env)
+	indexes := make(map[string]int, len(e.indexes))
+	for k, v := range e.indexes {
+		indexes[k] = v
+	}
+	return &Env{env: env, indexes: indexes, lookup: e.lookup, access: e.access}
+}
@@ -0,0 +1,245 @@
+package parse
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEnvClone(t *testing.T) {
+	env := NewEnv([]string{"FOO=foo", "BAR=bar"})
+	clone := env.Clone()
+
+	clone.Set("FOO", "changed")
+	clone.Set("NEW", "new")
+
+	if got := env.Get("FOO"); got != "foo" {
+		t.Errorf("original FOO: expected %q, got %q", "foo", got)
+	}
+	if env.Has("NEW") {
+		t.Error("original should not have NEW")
+	}
+	if got := clone.Get("FOO"); got != "changed" {
+		t.Errorf("clone FOO: expected %q, got %q", "changed", got)
+	}
+	if got := clone.Get("NEW"); got != "new" {
+		t.Errorf("clone NEW: expected %q, got %q", "new", got)
+	}
+
+	env.Set("BAR", "original")
+	if got := clone.Get("BAR"); got != "bar" {
+		t.Errorf("clone BAR: expected %q, got %q", "bar", got)
+	}
+}
+
+func TestEnvOverlay(t *testing.T) {
+	t.Setenv("ENVSUBST_OVERLAY_BASE", "base")
+	t.Setenv("ENVSUBST_OVERLAY_SHADOWED", "process")
+
+	env := NewEnvOverlay(map[string]string{
+		"ENVSUBST_OVERLAY_SHADOWED": "overlay",
+		"ENVSUBST_OVERLAY_ONLY":     "only",
+	})
+
+	testCases := []struct {
+		name, key, expected string
+		has                 bool
+	}{
+		{"overlay hit", "ENVSUBST_OVERLAY_ONLY", "only", true},
+		{"overlay shadows base", "ENVSUBST_OVERLAY_SHADOWED", "overlay", true},
+		{"base hit", "ENVSUBST_OVERLAY_BASE", "base", true},
+		{"miss", "ENVSUBST_OVERLAY_MISSING", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := env.Get(tc.key); got != tc.expected {
+				t.Errorf("Get(%q): expected %q, got %q", tc.key, tc.expected, got)
+			}
+			if got := env.Has(tc.key); got != tc.has {
+				t.Errorf("Has(%q): expected %v, got %v", tc.key, tc.has, got)
+			}
+		})
+	}
+
+	// the base is read lazily, changes after construction are visible
+	t.Setenv("ENVSUBST_OVERLAY_MISSING", "late")
+	if got := env.Get("ENVSUBST_OVERLAY_MISSING"); got != "late" {
+		t.Errorf("expected lazy lookup %q, got %q", "late", got)
+	}
+
+	if got := len(env.Strings()); got != 2 {
+		t.Errorf("expected Strings to report the 2 overrides, got %d", got)
+	}
+
+	result, err := New("overlay", env, &Restrictions{NoUnset: true}).Parse("$ENVSUBST_OVERLAY_ONLY-$ENVSUBST_OVERLAY_BASE")
+	if err != nil || result != "only-base" {
+		t.Errorf("expected %q without error, got %q, %v", "only-base", result, err)
+	}
+}
+
+func TestOSEnv(t *testing.T) {
+	env := OSEnv()
+	if env.Has("ENVSUBST_OSENV_LATE") {
+		t.Fatal("ENVSUBST_OSENV_LATE should not be set yet")
+	}
+
+	t.Setenv("ENVSUBST_OSENV_LATE", "late")
+	if !env.Has("ENVSUBST_OSENV_LATE") || env.Get("ENVSUBST_OSENV_LATE") != "late" {
+		t.Errorf("expected lazy env to see %q, got %q", "late", env.Get("ENVSUBST_OSENV_LATE"))
+	}
+
+	t.Setenv("ENVSUBST_OSENV_LATE", "changed")
+	result, err := New("os", env, &Restrictions{}).Parse("${ENVSUBST_OSENV_LATE}")
+	if err != nil || result != "changed" {
+		t.Errorf("expected %q without error, got %q, %v", "changed", result, err)
+	}
+
+	env.Set("ENVSUBST_OSENV_LOCAL", "local")
+	if _, ok := os.LookupEnv("ENVSUBST_OSENV_LOCAL"); ok {
+		t.Error("Set should not modify the process environment")
+	}
+	if got := env.Get("ENVSUBST_OSENV_LOCAL"); got != "local" {
+		t.Errorf("expected %q, got %q", "local", got)
+	}
+}
+
+func TestEnvGetAll(t *testing.T) {
+	env := NewEnv([]string{"FOO=foo", "BAR=bar", "FOO=duplicate", "EQ=a=b"})
+	env.Set("BAR", "changed")
+	env.Set("NEW", "new")
+	env.Set("EMPTY", "")
+
+	expected := map[string]string{"FOO": "foo", "BAR": "changed", "EQ": "a=b", "NEW": "new", "EMPTY": ""}
+	got := env.GetAll()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d variables, got %v", len(expected), got)
+	}
+	for key, value := range expected {
+		if v, ok := got[key]; !ok || v != value {
+			t.Errorf("%s: expected %q, got %q (present: %v)", key, value, v, ok)
+		}
+	}
+
+	got["FOO"] = "modified"
+	if env.Get("FOO") != "foo" {
+		t.Error("modifying the snapshot should not affect the env")
+	}
+}
+
+func TestIsValidName(t *testing.T) {
+	testCases := []struct {
+		name  string
+		valid bool
+	}{
+		{"HOME", true},
+		{"my_var2", true},
+		{"_PRIVATE", true},
+		{"été", true},
+		{"", false},
+		{"1VAR", false},
+		{"2", false},
+		{"MY VAR", false},
+		{" VAR", false},
+		{"VAR-NAME", false},
+		{"VAR=x", false},
+	}
+	for _, tc := range testCases {
+		if got := IsValidName(tc.name); got != tc.valid {
+			t.Errorf("IsValidName(%q): expected %v, got %v", tc.name, tc.valid, got)
+		}
+	}
+}
+
+func TestEnvSetChecked(t *testing.T) {
+	env := NewEnv(nil)
+	if err := env.SetChecked("GOOD_1", "v"); err != nil || env.Get("GOOD_1") != "v" {
+		t.Errorf("expected GOOD_1 to be set, got %q, %v", env.Get("GOOD_1"), err)
+	}
+	for _, key := range []string{"1BAD", "BAD NAME", ""} {
+		err := env.SetChecked(key, "v")
+		if err == nil {
+			t.Errorf("%q: expected an error", key)
+		}
+		if env.Has(key) {
+			t.Errorf("%q: should not be set", key)
+		}
+	}
+}
+
+func TestNewEnvWithPolicy(t *testing.T) {
+	vars := func() []string { return []string{"HOME=/home/user", "PATH=/usr/bin", "HOME=/tmp", "HOME=/override"} }
+
+	first := NewEnvWithPolicy(vars(), false)
+	if got := first.Get("HOME"); got != "/home/user" {
+		t.Errorf("first wins: expected %q, got %q", "/home/user", got)
+	}
+	last := NewEnvWithPolicy(vars(), true)
+	if got := last.Get("HOME"); got != "/override" {
+		t.Errorf("last wins: expected %q, got %q", "/override", got)
+	}
+
+	for _, env := range []*Env{first, last} {
+		if got := env.Get("PATH"); got != "/usr/bin" {
+			t.Errorf("PATH: expected %q, got %q", "/usr/bin", got)
+		}
+		if n := len(env.Strings()); n != 2 {
+			t.Errorf("expected 2 variables, got %q", env.Strings())
+		}
+	}
+
+	last.Set("HOME", "/set")
+	if got := last.GetAll()["HOME"]; got != "/set" {
+		t.Errorf("expected Set to update the kept entry, got %q", got)
+	}
+}
+
+func TestStrictEnv(t *testing.T) {
+	t.Setenv("ENVSUBST_STRICT_PROCESS", "process")
+	vars := map[string]string{"HOST": "localhost", "PORT": "8080", "UNUSED": "x"}
+
+	testCases := []struct {
+		name, input, expected string
+		accessed, undeclared  []string
+	}{
+		{"declared only", "$HOST:${PORT}", "localhost:8080", []string{"HOST", "PORT"}, nil},
+		{"undeclared with default", "${HOST}:${TLS_PORT:-443}", "localhost:443", []string{"HOST", "TLS_PORT"}, []string{"TLS_PORT"}},
+		{"process environment is not read", "[$ENVSUBST_STRICT_PROCESS]", "[]", []string{"ENVSUBST_STRICT_PROCESS"}, []string{"ENVSUBST_STRICT_PROCESS"}},
+		{"unused alternate branch", "${HOST:+$PORT}", "8080", []string{"HOST", "PORT"}, nil},
+		{"no variables", "plain text", "plain text", []string{}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := NewStrictEnv(vars)
+			result, err := New(tc.name, env, nil).Parse(tc.input)
+			if err != nil || result != tc.expected {
+				t.Fatalf("expected %q, got %q, %v", tc.expected, result, err)
+			}
+			if got := env.AccessedKeys(); !reflect.DeepEqual(got, tc.accessed) {
+				t.Errorf("AccessedKeys: expected %q, got %q", tc.accessed, got)
+			}
+			err = env.CheckUndeclared()
+			if tc.undeclared == nil && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tc.undeclared != nil && !errors.Is(err, Error("", "Undeclared")) {
+				t.Errorf("expected an Undeclared error, got %v", err)
+			}
+		})
+	}
+
+	env := NewStrictEnv(vars)
+	if _, _, err := New("assign", env, nil).ParseWithEnv("${A:=$HOST} ${B:-x}"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"A", "B", "HOST"}; !reflect.DeepEqual(env.AccessedKeys(), expected) {
+		t.Errorf("expected accesses through the clone to be recorded, got %q", env.AccessedKeys())
+	}
+	if err := env.CheckUndeclared(); err == nil || err.Error() != "undeclared variables read: A, B" {
+		t.Errorf("expected the undeclared keys in the error, got %v", err)
+	}
+
+	if keys := NewEnv([]string{"A=a"}).AccessedKeys(); keys != nil {
+		t.Errorf("expected no record for a plain Env, got %q", keys)
+	}
+}
@@ -0,0 +1,454 @@
+package parse
+
+import (
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	tparse "text/template/parse"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FilterContext describes the substitution a filter is applied to.
+type FilterContext struct {
+	Name   string // Variable identifier name (e.g., "VAR" from "${VAR|indent}")
+	Column int    // Column, in runes, at which the substitution starts on its line of the output
+	Env    *Env
+	Set    bool // Whether the variable is set, possibly to an empty value
+
+	// Lookup returns the value of another variable and whether it is set, looked
+	// up like the variable of the substitution: through the NameMapper, the Fallback,
+	// the Resolvers, OnMissing and the := assignments of the current parse.
+	Lookup func(name string) (string, bool)
+}
+
+// FilterFunc transforms a substituted value. The args are the ':' separated
+// arguments following the filter name, e.g. ["4"] for ${VAR|indent:4}.
+type FilterFunc func(ctx *FilterContext, value string, args []string) (string, error)
+
+// FilterCall is a single filter invocation of a substitution.
+type FilterCall struct {
+	Name string
+	Args []string
+}
+
+// String returns the source form of the filter call, e.g. "indent:4".
+func (f FilterCall) String() string {
+	return strings.Join(append([]string{f.Name}, f.Args...), ":")
+}
+
+// Filter System
+//
+// Filters post-process the value of a substitution using the pipeline syntax
+// ${VAR|name:arg1:arg2}. Several filters can be chained, ${VAR|a|b:1}, and are
+// applied from left to right. Unknown filter names are reported as parse errors.
+// A single filter may also be written as an operator, ${VAR@name}.
+//
+// Example:
+//   RegisterFilter("quote", func(ctx *FilterContext, v string, args []string) (string, error) {
+//       return strconv.Quote(v), nil
+//   })
+//
+// This would enable ${VAR|quote} to emit the value as a quoted Go string.
+
+// filterDefinitions maps filter names to their implementation
+var filterDefinitions = map[string]FilterFunc{
+	"indent":     indentFilter,                   // indent[:N] re-indents continuation lines
+	"urlencode":  urlencodeFilter,                // urlencode percent-encodes the value for a URL query
+	"urldecode":  urldecodeFilter,                // urldecode decodes a percent-encoded value
+	"replace":    replaceFilter(1),               // replace:pattern:string replaces the first match, ${VAR/pattern/string}
+	"replaceall": replaceFilter(-1),              // replaceall:pattern:string replaces all matches, ${VAR//pattern/string}
+	"trimprefix": trimFilter(strings.TrimPrefix), // trimprefix:s removes the literal prefix s
+	"trimsuffix": trimFilter(strings.TrimSuffix), // trimsuffix:s removes the literal suffix s
+	"int":        intFilter(10),                  // int validates an integer value and formats it in decimal
+	"hex":        intFilter(16),                  // hex formats an integer value in hexadecimal
+	"tpl":        tplFilter,                      // tpl executes the value as a text/template, see Restrictions.AllowTemplateTransform
+	"pad":        padFilter(false),               // pad:N[:trunc] right-pads the value with spaces to N runes
+	"padleft":    padFilter(true),                // padleft:N[:trunc] left-pads the value with spaces to N runes
+	"field":      fieldFilter,                    // field:N[:sep] takes the Nth field of the value split on sep
+	"duration":   durationFilter,                 // duration validates a Go duration and formats it canonically
+	"bytes":      bytesFilter,                    // bytes converts a size such as 1Gi or 512MB to a number of bytes
+	"eq":         eqFilter,                       // eq:value:then:else renders then if the value equals value, else otherwise
+	"bool":       boolFilter,                     // bool normalizes a truthy or falsy value to true or false
+	"or":         orFilter,                       // or:B:C renders the first non-empty of the value, B and C
+	"name":       nameFilter,                     // name renders the name of the variable if it is set
+}
+
+// RegisterFilter registers a filter usable as ${VAR|name}, replacing any
+// existing filter with the same name.
+func RegisterFilter(name string, filter FilterFunc) {
+	filterDefinitions[name] = filter
+}
+
+// parseFilters parses the filter pipeline of a substitution, e.g. "indent:2|trim".
+func parseFilters(spec string) ([]FilterCall, error) {
+	var calls []FilterCall
+	for _, s := range strings.Split(spec, "|") {
+		parts := strings.Split(s, ":")
+		if _, ok := filterDefinitions[parts[0]]; !ok {
+			return nil, fmt.Errorf("unknown filter %q", parts[0])
+		}
+		calls = append(calls, FilterCall{parts[0], parts[1:]})
+	}
+	return calls, nil
+}
+
+// indentFilter prefixes every non-empty line after the first with spaces, so a
+// multi-line value lines up under the column where the substitution began.
+// An explicit width may be given as the first argument: ${VAR|indent:4}.
+func indentFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	width := ctx.Column
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("indent: invalid width %q", args[0])
+		}
+		width = n
+	}
+	pad := strings.Repeat(" ", width)
+	lines := strings.Split(value, "\n")
+	for i := 1; i < len(lines); i++ {
+		if lines[i] != "" {
+			lines[i] = pad + lines[i]
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// urlencodeFilter escapes the value so it can be placed inside a URL query.
+func urlencodeFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	return url.QueryEscape(value), nil
+}
+
+// urldecodeFilter is the inverse of urlencodeFilter.
+func urldecodeFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	return url.QueryUnescape(value)
+}
+
+// trimFilter returns a filter removing the literal string given as argument with
+// trim, the argument may contain ':' as in ${VAR|trimprefix:http://}.
+func trimFilter(trim func(s, cut string) string) FilterFunc {
+	return func(ctx *FilterContext, value string, args []string) (string, error) {
+		return trim(value, strings.Join(args, ":")), nil
+	}
+}
+
+// intFilter returns a filter parsing the value as a decimal integer and
+// formatting it in the given base, a value that is not an integer is an error.
+func intFilter(base int) FilterFunc {
+	return func(ctx *FilterContext, value string, args []string) (string, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid integer '%s'", value)
+		}
+		return strconv.FormatInt(n, base), nil
+	}
+}
+
+// durationFilter parses the value as a Go duration, e.g. 90s or 1h30m, and
+// formats it canonically, so that ${TIMEOUT|duration} renders 1m30s for 90s.
+func durationFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid duration '%s'", value)
+	}
+	return d.String(), nil
+}
+
+// boolFilter normalizes the common spellings of booleans, 1/0, yes/no, on/off
+// and true/false in any case, to "true" or "false". Any other value is an error.
+func boolFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	switch strings.ToLower(value) {
+	case "1", "yes", "on", "true":
+		return "true", nil
+	case "0", "no", "off", "false":
+		return "false", nil
+	}
+	return "", fmt.Errorf("invalid boolean '%s'", value)
+}
+
+// sizeUnits maps the unit suffixes accepted by bytesFilter to their multiplier.
+// The B suffix is optional and may follow any other unit: 1Gi, 1GiB.
+var sizeUnits = map[string]int64{
+	"":   1,
+	"k":  1e3,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"E":  1e18,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+}
+
+// bytesFilter parses the value as a size, a non-negative decimal number with an
+// optional decimal (k, M, G, ...) or binary (Ki, Mi, Gi, ...) unit, and formats
+// it as a number of bytes: ${SIZE|bytes} renders 1073741824 for 1Gi and
+// 1500000 for 1.5MB. Sizes that are not a whole number of bytes are an error.
+func bytesFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	i := strings.IndexFunc(value, func(r rune) bool { return r != '.' && (r < '0' || r > '9') })
+	if i < 0 {
+		i = len(value)
+	}
+	number, unit := value[:i], strings.TrimSuffix(value[i:], "B")
+	mult, ok := sizeUnits[unit]
+	n, valid := new(big.Rat).SetString(number)
+	if !ok || !valid || number == "" || strings.HasPrefix(number, ".") {
+		return "", fmt.Errorf("invalid size '%s'", value)
+	}
+	n.Mul(n, new(big.Rat).SetInt64(mult))
+	if !n.IsInt() {
+		return "", fmt.Errorf("invalid size '%s': not a whole number of bytes", value)
+	}
+	if !n.Num().IsInt64() {
+		return "", fmt.Errorf("invalid size '%s': out of range", value)
+	}
+	return n.Num().String(), nil
+}
+
+// tplFilter parses the value as a text/template and executes it with the variables
+// it references as data, looked up like the variable of the substitution, so that
+// {{.OTHER}} in the value renders the value of OTHER. A variable that is not set is
+// an error.
+func tplFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	tmpl, err := template.New(ctx.Name).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", err
+	}
+	fields := make(map[string]bool)
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			templateFields(t.Tree.Root, fields)
+		}
+	}
+	data := make(map[string]string, len(fields))
+	if ctx.Lookup != nil {
+		for name := range fields {
+			if v, ok := ctx.Lookup(name); ok {
+				data[name] = v
+			}
+		}
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// templateFields adds to fields the names of the top-level fields of the data a
+// template node refers to, e.g. A and B for {{if .A}}{{$.B}}{{end}}.
+func templateFields(n tparse.Node, fields map[string]bool) {
+	switch n := n.(type) {
+	case *tparse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			templateFields(c, fields)
+		}
+	case *tparse.ActionNode:
+		templateFields(n.Pipe, fields)
+	case *tparse.IfNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *tparse.RangeNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *tparse.WithNode:
+		templateBranchFields(&n.BranchNode, fields)
+	case *tparse.TemplateNode:
+		templateFields(n.Pipe, fields)
+	case *tparse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			templateFields(c, fields)
+		}
+	case *tparse.CommandNode:
+		for _, arg := range n.Args {
+			templateFields(arg, fields)
+		}
+	case *tparse.ChainNode:
+		templateFields(n.Node, fields)
+	case *tparse.FieldNode:
+		fields[n.Ident[0]] = true
+	case *tparse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			fields[n.Ident[1]] = true
+		}
+	}
+}
+
+// templateBranchFields adds the fields of an if, range or with node.
+func templateBranchFields(n *tparse.BranchNode, fields map[string]bool) {
+	templateFields(n.Pipe, fields)
+	templateFields(n.List, fields)
+	templateFields(n.ElseList, fields)
+}
+
+// padFilter returns a filter padding the value with spaces to the width args[0],
+// counted in runes, on the left if left is set. Longer values are kept as is,
+// unless "trunc" is given as second argument: ${VAR|pad:10:trunc}.
+func padFilter(left bool) FilterFunc {
+	return func(ctx *FilterContext, value string, args []string) (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("pad: width expected")
+		}
+		width, err := strconv.Atoi(args[0])
+		if err != nil || width < 0 {
+			return "", fmt.Errorf("pad: invalid width %q", args[0])
+		}
+		trunc := false
+		if len(args) > 1 {
+			if args[1] != "trunc" || len(args) > 2 {
+				return "", fmt.Errorf("pad: invalid option %q", strings.Join(args[1:], ":"))
+			}
+			trunc = true
+		}
+		n := utf8.RuneCountInString(value)
+		switch {
+		case n > width && trunc:
+			return string([]rune(value)[:width]), nil
+		case n >= width:
+			return value, nil
+		case left:
+			return strings.Repeat(" ", width-n) + value, nil
+		}
+		return value + strings.Repeat(" ", width-n), nil
+	}
+}
+
+// fieldFilter splits the value on the separator args[1], the rest of the arguments
+// included so that ${VAR|field:2::} splits on ':', and returns the field args[0]
+// counting from 1, like cut -f. Without a separator the value is split on white
+// space. A field past the last one is empty.
+func fieldFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("field: index expected")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return "", fmt.Errorf("field: invalid index %q", args[0])
+	}
+	var fields []string
+	if sep := strings.Join(args[1:], ":"); sep != "" {
+		fields = strings.Split(value, sep)
+	} else {
+		fields = strings.Fields(value)
+	}
+	if n > len(fields) {
+		return "", nil
+	}
+	return fields[n-1], nil
+}
+
+// eqFilter renders args[1] if the value equals args[0] and args[2] otherwise, so
+// that ${ENV|eq:prod:high:low} renders "high" in production. Either branch may be
+// empty, neither may contain ':'.
+func eqFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", fmt.Errorf("eq: expected value:then:else, got %q", strings.Join(args, ":"))
+	}
+	if value == args[0] {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+// orFilter coalesces variables: it renders the value if it is not empty, else the
+// value of the first variable named by args that is set and not empty, looked up
+// in order like the variable of the substitution, else "". As with chained :- operators, a set but empty
+// variable is skipped, so ${A|or:B:C} is ${A:-${B:-$C}}. The variable of the
+// substitution itself may be unset or empty under NoUnset, NoEmpty and Required.
+func orFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("or: expected variable names")
+	}
+	if value != "" || ctx.Lookup == nil {
+		return value, nil
+	}
+	for _, name := range args {
+		if v, _ := ctx.Lookup(name); v != "" {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+// nameFilter renders the name of the variable instead of its value if it is set,
+// even to an empty value, and "" otherwise, so that ${DEBUG@name} ${TRACE@name}
+// lists the enabled features. The variable is still checked by NoUnset.
+func nameFilter(ctx *FilterContext, value string, args []string) (string, error) {
+	if !ctx.Set {
+		return "", nil
+	}
+	return ctx.Name, nil
+}
+
+// replaceFilter returns a filter replacing up to n matches of the literal pattern
+// args[0] by the replacement args[1], n < 0 replaces all matches.
+// An empty pattern leaves the value unchanged.
+func replaceFilter(n int) FilterFunc {
+	return func(ctx *FilterContext, value string, args []string) (string, error) {
+		if len(args) == 0 || args[0] == "" {
+			return value, nil
+		}
+		pattern, replacement := args[0], strings.Join(args[1:], ":")
+		var b strings.Builder
+		for n := n; n != 0; n-- {
+			i := strings.Index(value, pattern)
+			if i < 0 {
+				break
+			}
+			b.WriteString(value[:i])
+			b.WriteString(expandReplacement(replacement, value[i:i+len(pattern)]))
+			value = value[i+len(pattern):]
+		}
+		b.WriteString(value)
+		return b.String(), nil
+	}
+}
+
+// expandReplacement expands the escapes of a replacement string for the given
+// match: '&' is the matched text, \U and \L convert the following text to upper
+// or lower case until \E, and a backslash makes the next character literal.
+func expandReplacement(replacement, match string) string {
+	var b strings.Builder
+	conv := func(r rune) rune { return r }
+	write := func(s string) {
+		for _, r := range s {
+			b.WriteRune(conv(r))
+		}
+	}
+	rs := []rune(replacement)
+	for i := 0; i < len(rs); i++ {
+		switch {
+		case rs[i] == '&':
+			write(match)
+		case rs[i] == '\\' && i+1 < len(rs):
+			i++
+			switch rs[i] {
+			case 'U':
+				conv = unicode.ToUpper
+			case 'L':
+				conv = unicode.ToLower
+			case 'E':
+				conv = func(r rune) rune { return r }
+			default:
+				write(string(rs[i]))
+			}
+		default:
+			write(string(rs[i]))
+		}
+	}
+	return b.String()
+}
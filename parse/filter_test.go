@@ -0,0 +1,553 @@
+package parse
+
+import (
+	"testing"
+)
+
+func TestIndentFilter(t *testing.T) {
+	env := NewEnv([]string{"CERT=line1\nline2", "SCRIPT=echo a\n\necho b", "ONE=single", "KEY=longvalue"})
+
+	testCases := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"indent to column", "key:\n  value: ${CERT|indent}", "key:\n  value: line1\n         line2", false},
+		{"indent block scalar", "script: |\n    ${SCRIPT|indent}\n", "script: |\n    echo a\n\n    echo b\n", false},
+		{"explicit width", "  - ${CERT|indent:6}", "  - line1\n      line2", false},
+		{"zero width", "  ${CERT|indent:0}", "  line1\nline2", false},
+		{"single line value", "    x: ${ONE|indent}", "    x: single", false},
+		{"after a substitution", "$KEY: ${CERT|indent}", "longvalue: line1\n           line2", false},
+		{"after a multi-line substitution", "${CERT}: ${CERT|indent}", "line1\nline2: line1\n       line2", false},
+		{"after a shorter substitution", "${ONE:-a much longer default}: ${CERT|indent}", "single: line1\n        line2", false},
+		{"nested", "key: ${NOTSET:-${CERT|indent}}", "key: line1\n     line2", false},
+		{"nested after default text", "$KEY: ${NOTSET:-x ${CERT|indent}}", "longvalue: x line1\n             line2", false},
+		{"nested after a multi-line piece", "${NOTSET:-${CERT} ${CERT|indent}}", "line1\nline2 line1\n      line2", false},
+		{"unset value", "  ${NOTSET|indent}", "  ", false},
+		{"chained filters", "  ${CERT|indent:1|indent:1}", "  line1\n  line2", false},
+		{"invalid width", "${CERT|indent:x}", "", true},
+		{"unknown filter", "${CERT|nope}", "", true},
+		{"empty filter", "${CERT|}", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestFilterKeepUnset(t *testing.T) {
+	for _, input := range []string{"${NOTSET|indent:2}", "${NOTSET@urlencode}", "a ${NOTSET|indent|urlencode} b"} {
+		result, err := New("test", NewEnv(nil), &Restrictions{KeepUnset: true}).Parse(input)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result != input {
+			t.Errorf("expected %q, got %q", input, result)
+		}
+	}
+}
+
+func TestURLFilters(t *testing.T) {
+	env := NewEnv([]string{"Q=a b&c=d/é?", "ENC=a+b%26c%3Dd", "BAD=100%zz"})
+
+	testCases := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"urlencode operator", "?q=${Q@urlencode}", "?q=a+b%26c%3Dd%2F%C3%A9%3F", false},
+		{"urlencode filter", "?q=${Q|urlencode}", "?q=a+b%26c%3Dd%2F%C3%A9%3F", false},
+		{"urldecode operator", "${ENC@urldecode}", "a b&c=d", false},
+		{"round trip", "${Q|urlencode|urldecode}", "a b&c=d/é?", false},
+		{"urlencode unset", "${NOTSET@urlencode}", "", false},
+		{"invalid percent sequence", "${BAD@urldecode}", "", true},
+		{"unknown operator", "${Q@nope}", "", true},
+		{"operator does not chain", "${Q@urlencode|urldecode}", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestReplaceFilter(t *testing.T) {
+	env := NewEnv([]string{"V=foo-bar-foo", "P=/usr/local/bin", "U=été été"})
+
+	testCases := []struct {
+		name, input, expected string
+	}{
+		{"replace first", "${V/foo/baz}", "baz-bar-foo"},
+		{"replace all", "${V//foo/baz}", "baz-bar-baz"},
+		{"delete match", "${V/foo}", "-bar-foo"},
+		{"delete all matches", "${V//-}", "foobarfoo"},
+		{"no match", "${V/qux/baz}", "foo-bar-foo"},
+		{"empty pattern", "${V//x}", "foo-bar-foo"},
+		{"escaped slash in pattern", "${P//\\//:}", ":usr:local:bin"},
+		{"matched text", "${V/bar/[&]}", "foo-[bar]-foo"},
+		{"escaped ampersand", "${V/bar/\\&}", "foo-&-foo"},
+		{"uppercase match", "${V//foo/\\U&}", "FOO-bar-FOO"},
+		{"uppercase until end", "${V/bar/\\U&x\\Ey}", "foo-BARXy-foo"},
+		{"lowercase", "${V/foo/\\LABC&}", "abcfoo-bar-foo"},
+		{"multi-byte uppercase", "${U//été/\\U&}", "ÉTÉ ÉTÉ"},
+		{"replace filter syntax", "${V|replace:foo:a:b}", "a:b-bar-foo"},
+		{"unset variable", "${NOTSET/foo/bar}", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestPadFilter(t *testing.T) {
+	env := NewEnv([]string{"S=abc", "L=abcdefgh", "U=été"})
+
+	testCases := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"pad shorter", "[${S|pad:5}]", "[abc  ]", false},
+		{"pad equal", "[${S|pad:3}]", "[abc]", false},
+		{"pad longer", "[${L|pad:5}]", "[abcdefgh]", false},
+		{"pad longer truncated", "[${L|pad:5:trunc}]", "[abcde]", false},
+		{"padleft shorter", "[${S|padleft:5}]", "[  abc]", false},
+		{"padleft equal", "[${S|padleft:3:trunc}]", "[abc]", false},
+		{"padleft longer truncated", "[${L|padleft:5:trunc}]", "[abcde]", false},
+		{"multi-byte counts runes", "[${U|pad:5}]", "[été  ]", false},
+		{"multi-byte truncated", "[${U|padleft:2:trunc}]", "[ét]", false},
+		{"unset value", "[${NOTSET|pad:2}]", "[  ]", false},
+		{"missing width", "${S|pad}", "", true},
+		{"invalid width", "${S|pad:x}", "", true},
+		{"invalid option", "${S|pad:5:cut}", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestTrimFilters(t *testing.T) {
+	env := NewEnv([]string{"V=foobarfoo", "URL=https://example.com", "P=foo"})
+
+	testCases := []struct {
+		name, input, expected string
+	}{
+		{"prefix present", "${V|trimprefix:foo}", "barfoo"},
+		{"prefix absent", "${V|trimprefix:bar}", "foobarfoo"},
+		{"prefix equals value", "[${P|trimprefix:foo}]", "[]"},
+		{"prefix is not a glob", "${V|trimprefix:f*}", "foobarfoo"},
+		{"prefix with colon", "${URL|trimprefix:https://}", "example.com"},
+		{"suffix present", "${V|trimsuffix:foo}", "foobar"},
+		{"suffix absent", "${V|trimsuffix:bar}", "foobarfoo"},
+		{"suffix equals value", "[${P|trimsuffix:foo}]", "[]"},
+		{"suffix removed once", "${V|trimsuffix:o}", "foobarfo"},
+		{"chained", "${V|trimprefix:foo|trimsuffix:foo}", "bar"},
+		{"empty argument", "${V|trimprefix}", "foobarfoo"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestTplFilter(t *testing.T) {
+	env := NewEnv([]string{"HOST=db.local", "URL=postgres://{{.HOST}}:5432", "BAD={{.HOST", "MISSING={{.NOPE}}", "PLAIN=text"})
+
+	testCases := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"value referencing another variable", "${URL@tpl}", "postgres://db.local:5432", false},
+		{"filter syntax", "${URL|tpl|urlencode}", "postgres%3A%2F%2Fdb.local%3A5432", false},
+		{"value without actions", "${PLAIN@tpl}", "text", false},
+		{"invalid template", "${BAD@tpl}", "", true},
+		{"missing key", "${MISSING@tpl}", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{AllowTemplateTransform: true}).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+
+	if _, err := New("test", env, &Restrictions{}).Parse("${URL@tpl}"); err == nil {
+		t.Error("expected the tpl filter to be rejected unless allowed")
+	}
+}
+
+// TestTplFilterLookup verifies that the data of the tpl filter is looked up like the
+// variable of the substitution, so that lazy environments and the Fallback work
+func TestTplFilterLookup(t *testing.T) {
+	t.Setenv("TPL_URL", "http://{{.TPL_HOST}}{{if .TPL_PORT}}:{{$.TPL_PORT}}{{end}}")
+	t.Setenv("TPL_HOST", "db.local")
+	t.Setenv("TPL_PORT", "5432")
+
+	testCases := []struct {
+		name, input, expected string
+		env                   *Env
+		restrict              *Restrictions
+	}{
+		{"os env", "${TPL_URL@tpl}", "http://db.local:5432", OSEnv(), &Restrictions{AllowTemplateTransform: true}},
+		{"overlay", "${TPL_URL@tpl}", "http://db.local:80", NewEnvOverlay(map[string]string{"TPL_PORT": "80"}), &Restrictions{AllowTemplateTransform: true}},
+		{"fallback", "${URL@tpl}", "http://fallback", NewEnv([]string{"URL=http://{{.HOST}}"}),
+			&Restrictions{AllowTemplateTransform: true, Fallback: NewEnv([]string{"HOST=fallback"})}},
+		{"assignment", "${HOST:=assigned}${URL@tpl}", "assignedhttp://assigned", NewEnv([]string{"URL=http://{{.HOST}}"}),
+			&Restrictions{AllowTemplateTransform: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", tc.env, tc.restrict).Parse(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestIntFilters(t *testing.T) {
+	env := NewEnv([]string{"PORT=8080", "NEG=-42", "PLUS=+7", "ZEROS=007", "BAD=abc", "FLOAT=1.5", "EMPTY=", "BIG=255"})
+
+	testCases := []struct {
+		name, input, expected, errMsg string
+	}{
+		{"valid integer", "${PORT|int}", "8080", ""},
+		{"negative integer", "${NEG|int}", "-42", ""},
+		{"canonical form", "${PLUS|int}:${ZEROS|int}", "7:7", ""},
+		{"invalid integer", "${BAD|int}", "", "BAD: invalid integer 'abc'"},
+		{"float", "${FLOAT|int}", "", "FLOAT: invalid integer '1.5'"},
+		{"empty", "${EMPTY|int}", "", "EMPTY: invalid integer ''"},
+		{"hex", "${BIG|hex}", "ff", ""},
+		{"negative hex", "${NEG@hex}", "-2a", ""},
+		{"invalid hex", "${BAD|hex}", "", "BAD: invalid integer 'abc'"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if tc.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.errMsg != "" && (err == nil || err.Error() != tc.errMsg) {
+				t.Fatalf("expected error %q, got %v", tc.errMsg, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestFieldFilter(t *testing.T) {
+	env := NewEnv([]string{"P=/usr/local/bin", "L=a:b::d:", "W=  one two\tthree ", "C=x,y"})
+
+	testCases := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"slash", "${P|field:2:/}", "usr", false},
+		{"leading separator", "[${P|field:1:/}]", "[]", false},
+		{"last slash field", "${P|field:4:/}", "bin", false},
+		{"colon", "${L|field:2::}", "b", false},
+		{"empty colon field", "[${L|field:3::}]", "[]", false},
+		{"trailing separator", "[${L|field:5::}]", "[]", false},
+		{"past trailing separator", "[${L|field:6::}]", "[]", false},
+		{"multi-character separator", "${L|field:2:::}", "d:", false},
+		{"white space", "${W|field:3}", "three", false},
+		{"out of range", "[${C|field:3:,}]", "[]", false},
+		{"chained", "${P|field:2:/|pad:4}", "usr ", false},
+		{"missing index", "${P|field}", "", true},
+		{"zero index", "${P|field:0:/}", "", true},
+		{"invalid index", "${P|field:x:/}", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestDurationFilter(t *testing.T) {
+	env := NewEnv([]string{"T=90s", "H=1h30m", "MS=1500ms", "ZERO=0", "NEG=-5m", "BAD=5 minutes", "UNITLESS=5", "EMPTY="})
+
+	testCases := []struct {
+		name, input, expected, errMsg string
+	}{
+		{"seconds", "${T|duration}", "1m30s", ""},
+		{"hours", "${H|duration}", "1h30m0s", ""},
+		{"milliseconds", "${MS|duration}", "1.5s", ""},
+		{"zero", "${ZERO|duration}", "0s", ""},
+		{"negative", "${NEG@duration}", "-5m0s", ""},
+		{"invalid", "${BAD|duration}", "", "BAD: invalid duration '5 minutes'"},
+		{"missing unit", "${UNITLESS|duration}", "", "UNITLESS: invalid duration '5'"},
+		{"empty", "${EMPTY|duration}", "", "EMPTY: invalid duration ''"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if tc.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.errMsg != "" && (err == nil || err.Error() != tc.errMsg) {
+				t.Fatalf("expected error %q, got %v", tc.errMsg, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestBytesFilter(t *testing.T) {
+	env := NewEnv([]string{
+		"PLAIN=512", "B=512B", "GI=1Gi", "GIB=1GiB", "MB=1.5MB", "K=2k", "KI=0.5Ki", "EI=7Ei",
+		"FRACTION=1.5", "UNIT=1Gb", "NEG=-1Gi", "WORD=big", "DOT=.5Ki", "OVERFLOW=8Ei", "EMPTY=",
+	})
+
+	testCases := []struct {
+		name, input, expected, errMsg string
+	}{
+		{"plain", "${PLAIN|bytes}", "512", ""},
+		{"byte suffix", "${B|bytes}", "512", ""},
+		{"binary", "${GI|bytes}", "1073741824", ""},
+		{"binary with byte suffix", "${GIB|bytes}", "1073741824", ""},
+		{"decimal fraction", "${MB|bytes}", "1500000", ""},
+		{"lowercase k", "${K@bytes}", "2000", ""},
+		{"binary fraction", "${KI|bytes}", "512", ""},
+		{"largest unit", "${EI|bytes}", "8070450532247928832", ""},
+		{"fraction of a byte", "${FRACTION|bytes}", "", "FRACTION: invalid size '1.5': not a whole number of bytes"},
+		{"unknown unit", "${UNIT|bytes}", "", "UNIT: invalid size '1Gb'"},
+		{"negative", "${NEG|bytes}", "", "NEG: invalid size '-1Gi'"},
+		{"no number", "${WORD|bytes}", "", "WORD: invalid size 'big'"},
+		{"leading dot", "${DOT|bytes}", "", "DOT: invalid size '.5Ki'"},
+		{"overflow", "${OVERFLOW|bytes}", "", "OVERFLOW: invalid size '8Ei': out of range"},
+		{"empty", "${EMPTY|bytes}", "", "EMPTY: invalid size ''"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if tc.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.errMsg != "" && (err == nil || err.Error() != tc.errMsg) {
+				t.Fatalf("expected error %q, got %v", tc.errMsg, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestEqFilter(t *testing.T) {
+	env := NewEnv([]string{"STAGE=prod", "DEV=dev", "EMPTY=", "PROD=Prod"})
+
+	testCases := []struct {
+		name, input, expected, errMsg string
+	}{
+		{"match", "${STAGE|eq:prod:high:low}", "high", ""},
+		{"no match", "${DEV|eq:prod:high:low}", "low", ""},
+		{"case sensitive", "${PROD|eq:prod:high:low}", "low", ""},
+		{"match empty", "${EMPTY|eq::none:some}", "none", ""},
+		{"empty branch", "[${DEV|eq:prod:high:}]", "[]", ""},
+		{"operator form", "${STAGE@eq:prod:1:0}", "1", ""},
+		{"chained", "${STAGE|eq:prod:high:low|pad:5}", "high ", ""},
+		{"unset", "${NOTSET|eq:prod:high:low}", "low", ""},
+		{"missing branch", "${STAGE|eq:prod:high}", "", `STAGE: eq: expected value:then:else, got "prod:high"`},
+		{"too many arguments", "${STAGE|eq:prod:a:b:c}", "", `STAGE: eq: expected value:then:else, got "prod:a:b:c"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if tc.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.errMsg != "" && (err == nil || err.Error() != tc.errMsg) {
+				t.Fatalf("expected error %q, got %v", tc.errMsg, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestOrFilter(t *testing.T) {
+	env := NewEnv([]string{"A=a", "B=b", "C=c", "EMPTY=", "ALSO_EMPTY="})
+
+	testCases := []struct {
+		name, input, expected, errMsg string
+	}{
+		{"first set", "${A|or:B:C}", "a", ""},
+		{"second set", "${NOTSET|or:B:C}", "b", ""},
+		{"last set", "${NOTSET|or:UNSET2:C}", "c", ""},
+		{"empty skipped", "${EMPTY|or:ALSO_EMPTY:C}", "c", ""},
+		{"empty argument skipped", "${NOTSET|or:EMPTY:B}", "b", ""},
+		{"all unset", "[${NOTSET|or:UNSET2:UNSET3}]", "[]", ""},
+		{"all empty", "[${EMPTY|or:ALSO_EMPTY}]", "[]", ""},
+		{"single name", "${EMPTY|or:A}", "a", ""},
+		{"operator form", "${NOTSET@or:B}", "b", ""},
+		{"chained", "${NOTSET|or:B|pad:3}", "b  ", ""},
+		{"no names", "${A|or}", "", "A: or: expected variable names"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, &Restrictions{}).Parse(tc.input)
+			if tc.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.errMsg != "" && (err == nil || err.Error() != tc.errMsg) {
+				t.Fatalf("expected error %q, got %v", tc.errMsg, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestOrFilterLookup verifies that the or filter looks up its variables like the
+// variable of the substitution, not only in the Env, and that its subject may be
+// unset or empty whatever the restrictions
+func TestOrFilterLookup(t *testing.T) {
+	env := NewEnv([]string{"A=a", "APP_B=mapped", "EMPTY="})
+
+	testCases := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+	}{
+		{"fallback", "${NOTSET|or:B}", "fallback", &Restrictions{Fallback: NewEnv([]string{"B=fallback"})}},
+		{"resolver", "${NOTSET|or:B}", "resolved", &Restrictions{Resolvers: []Resolver{&mapResolver{vars: map[string]string{"B": "resolved"}}}}},
+		{"name mapper", "${NOTSET|or:B}", "mapped", &Restrictions{NameMapper: func(name string) string { return "APP_" + name }}},
+		{"on missing", "${NOTSET|or:B}", "supplied", &Restrictions{OnMissing: func(name string) (string, bool) { return "supplied", name == "B" }}},
+		{"assignment", "${B:=assigned} ${NOTSET|or:B}", "assigned assigned", &Restrictions{}},
+		{"unset subject under NoUnset", "${NOTSET|or:A}", "a", &Restrictions{NoUnset: true}},
+		{"empty subject under NoEmpty", "${EMPTY|or:A}", "a", &Restrictions{NoUnset: true, NoEmpty: true, Required: true}},
+		{"unset subject under KeepUnset", "${NOTSET|or:A}", "a", &Restrictions{KeepUnset: true}},
+		{"chained under NoUnset", "${NOTSET|trimprefix:x|or:A|pad:2}", "a ", &Restrictions{NoUnset: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, tc.restrict).Parse(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestNameFilter(t *testing.T) {
+	env := NewEnv([]string{"DEBUG=1", "TRACE=", "METRICS=on"})
+
+	testCases := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+	}{
+		{"set", "${DEBUG@name}", "DEBUG", &Restrictions{}, false},
+		{"set empty", "${TRACE@name}", "TRACE", &Restrictions{}, false},
+		{"unset", "[${PROFILE@name}]", "[]", &Restrictions{}, false},
+		{"pipe form", "${METRICS|name}", "METRICS", &Restrictions{}, false},
+		{"features list", "${DEBUG@name} ${PROFILE@name} ${METRICS@name}", "DEBUG  METRICS", &Restrictions{}, false},
+		{"chained", "${DEBUG|name|pad:7}|", "DEBUG  |", &Restrictions{}, false},
+		{"set by fallback", "${PROFILE@name}", "PROFILE", &Restrictions{Fallback: NewEnv([]string{"PROFILE=cpu"})}, false},
+		{"assigned before", "${PROFILE:=cpu} ${PROFILE@name}", "cpu PROFILE", &Restrictions{}, false},
+		{"unset with NoUnset", "${PROFILE@name}", "", &Restrictions{NoUnset: true}, true},
+		{"set with NoUnset", "${DEBUG@name}", "DEBUG", &Restrictions{NoUnset: true}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, tc.restrict).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestBoolFilter(t *testing.T) {
+	truthy := []string{"1", "yes", "YES", "Yes", "on", "ON", "true", "True", "TRUE"}
+	falsy := []string{"0", "no", "NO", "No", "off", "Off", "false", "False", "FALSE"}
+	for expected, values := range map[string][]string{"true": truthy, "false": falsy} {
+		for _, value := range values {
+			env := NewEnv([]string{"FLAG=" + value})
+			result, err := New("test", env, &Restrictions{}).Parse("${FLAG|bool}")
+			if err != nil || result != expected {
+				t.Errorf("%q: expected %q, got %q, %v", value, expected, result, err)
+			}
+		}
+	}
+
+	for _, value := range []string{"", "2", "y", "n", "enabled", " true", "truthy"} {
+		env := NewEnv([]string{"FLAG=" + value})
+		_, err := New("test", env, &Restrictions{}).Parse("${FLAG@bool}")
+		if expected := "FLAG: invalid boolean '" + value + "'"; err == nil || err.Error() != expected {
+			t.Errorf("%q: expected error %q, got %v", value, expected, err)
+		}
+	}
+}
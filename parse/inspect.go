@@ -0,0 +1,641 @@
+package parse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OperatorsUsed returns the distinct expansion operators used in text, in order of
+// first appearance, e.g. [":-", "^^", "|indent"]. Filters are reported with their
+// leading '|' or '@'. The text is only lexed, no variable is evaluated.
+func (p *Parser) OperatorsUsed(text string) ([]string, error) {
+	l := lex(text, p.Restrict)
+	defer l.drain()
+
+	var ops []string
+	seen := make(map[string]bool)
+	add := func(op string) {
+		if !seen[op] {
+			seen[op] = true
+			ops = append(ops, op)
+		}
+	}
+	for {
+		switch t := l.nextItem(); {
+		case t.typ == itemEOF:
+			return ops, nil
+		case t.typ == itemError:
+			return nil, p.errorf(t.val)
+		case t.typ == itemPipe, t.typ == itemAt:
+			var spec strings.Builder
+			for n := l.nextItem(); n.typ != itemRightDelim; n = l.nextItem() {
+				if n.typ == itemEOF || n.typ == itemError {
+					return nil, p.errorf("bad substitution: unexpected " + n.String() + " in filter")
+				}
+				spec.WriteString(n.val)
+			}
+			for _, f := range strings.Split(spec.String(), "|") {
+				add(t.val + strings.SplitN(f, ":", 2)[0])
+			}
+		case isOperator(t.typ):
+			add(t.val)
+		}
+	}
+}
+
+// Variables returns the names of the variables referenced in text, in order of
+// appearance and once per reference, like the --variables option of GNU envsubst.
+// The text is only lexed, no variable is evaluated.
+func (p *Parser) Variables(text string) ([]string, error) {
+	l := lex(text, p.Restrict)
+	defer l.drain()
+
+	var names []string
+	for {
+		switch t := l.nextItem(); t.typ {
+		case itemEOF:
+			return names, nil
+		case itemError:
+			return nil, p.errorf(t.val)
+		case itemVariable:
+			names = append(names, p.ident(t.val))
+		}
+	}
+}
+
+// RequiredVariables returns the sorted names of the variables referenced in text
+// that must be set for it to render, and those that are optional. A variable is
+// optional if every reference to it is the subject of a default, alternate value
+// or ternary operator, such as ${PORT:-80}, is only evaluated depending on
+// another variable, like $B in ${A:-$B}, or follows an assignment such as
+// ${PORT:=80}. The text is only lexed, no variable is evaluated.
+func (p *Parser) RequiredVariables(text string) (required, optional []string, err error) {
+	l := lex(text, p.Restrict)
+	defer l.drain()
+
+	// a substitution being lexed
+	type frame struct {
+		subject     string   // the variable the substitution is about
+		op          itemType // its operator, zero until seen
+		conditional bool     // if it is only evaluated depending on another variable
+	}
+	var stack []*frame
+	requiredSet, optionalSet, assigned := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	add := func(name string, conditional bool) {
+		if conditional || assigned[name] {
+			optionalSet[name] = true
+		} else {
+			requiredSet[name] = true
+		}
+	}
+	// inner reports whether the content of the innermost substitution is only
+	// evaluated depending on another variable.
+	inner := func() bool {
+		if len(stack) == 0 {
+			return false
+		}
+		f := stack[len(stack)-1]
+		return f.conditional || isDefaultOperator(f.op) || f.op == itemQuestion
+	}
+	subject := false // if the next variable is the subject of a substitution
+Loop:
+	for {
+		t := l.nextItem()
+		switch t.typ {
+		case itemEOF:
+			break Loop
+		case itemError:
+			return nil, nil, p.errorf(t.val)
+		case itemLeftDelim:
+			stack = append(stack, &frame{conditional: inner()})
+			subject = true
+			continue
+		case itemRightDelim:
+			if len(stack) > 0 {
+				f := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if f.subject != "" {
+					add(f.subject, f.conditional || isDefaultOperator(f.op) || f.op == itemQuestion)
+					if !f.conditional && (f.op == itemEquals || f.op == itemColonEquals) {
+						// the variable is set for the rest of the input
+						assigned[f.subject] = true
+					}
+				}
+			}
+		case itemVariable:
+			switch {
+			case subject:
+				stack[len(stack)-1].subject = p.ident(t.val)
+			case len(stack) > 0 && literalArguments(stack[len(stack)-1].op):
+				// filter arguments and replacements are not expanded
+			default:
+				add(p.ident(t.val), inner())
+			}
+		case itemText:
+		default:
+			if f := stack[len(stack)-1]; f.op == 0 {
+				f.op = t.typ
+			}
+		}
+		subject = false
+	}
+
+	for name := range requiredSet {
+		required = append(required, name)
+	}
+	for name := range optionalSet {
+		if !requiredSet[name] {
+			optional = append(optional, name)
+		}
+	}
+	sort.Strings(required)
+	sort.Strings(optional)
+	return required, optional, nil
+}
+
+// literalArguments reports whether the text following the operator typ is used
+// literally, without expanding the variables in it.
+func literalArguments(typ itemType) bool {
+	switch typ {
+	case itemPipe, itemAt, itemSlash, itemSlashSlash:
+		return true
+	}
+	return false
+}
+
+// deprecatedOperators holds the operators reported to Restrictions.OnDeprecated,
+// in the form returned by OperatorsUsed. No operator is deprecated yet.
+var deprecatedOperators = map[string]bool{}
+
+// DeprecateOperator marks op as deprecated, e.g. ":=" or "|indent", so that its
+// uses are reported to Restrictions.OnDeprecated.
+func DeprecateOperator(op string) {
+	deprecatedOperators[op] = true
+}
+
+// isOperator reports whether typ is an expansion operator.
+func isOperator(typ itemType) bool {
+	switch typ {
+	case itemColonQuestion, itemCaretCaret, itemCommaComma, itemQuestion, itemSlash, itemSlashSlash:
+		return true
+	}
+	return isDefaultOperator(typ)
+}
+
+// UnsetVariable is a reference to a variable that is not set.
+type UnsetVariable struct {
+	Name string // Variable identifier name
+	Pos  Pos    // Position of the name in the input, e.g. 2 for "${VAR}"
+}
+
+// UnsetAt returns the references of text to unset variables that would be
+// substituted without a default, in order of appearance. A variable whose default
+// applies is not reported, the references of the default are instead. The text
+// is only parsed, restrictions such as NoUnset do not cause errors.
+func (p *Parser) UnsetAt(text string) ([]UnsetVariable, error) {
+	if p.Restrict.Preprocess != nil {
+		text = p.Restrict.Preprocess(text)
+	}
+	if err := p.build(text); err != nil {
+		return nil, err
+	}
+	var unset []UnsetVariable
+	for _, n := range p.nodes {
+		unset = appendUnset(unset, n)
+	}
+	return unset, nil
+}
+
+// ParseCollect parses text leniently like Parse without the NoUnset, NoEmpty and
+// Required restrictions nor MissingError rules, unset variables are substituted
+// as empty, and also returns the distinct names of the unset variables that were
+// substituted without a default, in order of appearance, e.g. to log the gaps of
+// a successful render. The error is only about the syntax of text.
+func (p *Parser) ParseCollect(text string) (string, []string, error) {
+	r := *p.Restrict
+	r.NoUnset, r.NoEmpty, r.Required = false, false, false
+	r.MissingRules = make([]MissingRule, len(p.Restrict.MissingRules))
+	for i, rule := range p.Restrict.MissingRules {
+		if rule.Policy == MissingError {
+			rule.Policy = MissingEmpty
+		}
+		r.MissingRules[i] = rule
+	}
+	var unset []UnsetVariable
+	q := *p
+	q.Restrict = &r
+	q.inspect = func(n Node) func(string, error) {
+		unset = appendUnset(unset, n)
+		return nil
+	}
+	out, err := q.Parse(text)
+	if err != nil {
+		return "", nil, err
+	}
+	var missing []string
+	seen := make(map[string]bool)
+	for _, u := range unset {
+		if !seen[u.Name] {
+			seen[u.Name] = true
+			missing = append(missing, u.Name)
+		}
+	}
+	return out, missing, nil
+}
+
+// appendUnset appends the unset variables the node n resolves to.
+func appendUnset(unset []UnsetVariable, n Node) []UnsetVariable {
+	switch n := n.(type) {
+	case *VariableNode:
+		if !n.isSet() {
+			unset = append(unset, UnsetVariable{n.Ident, n.Pos})
+		}
+	case *ChainNode:
+		unset = appendUnset(unset, expectedAlternative(n))
+	case *ListNode:
+		for _, piece := range n.Nodes {
+			unset = appendUnset(unset, piece)
+		}
+	case *SubstitutionNode:
+		switch {
+		case n.ExpType == itemQuestion:
+			branch := n.Else
+			if n.Variable.notEmpty() {
+				branch = n.Default
+			}
+			if branch != nil {
+				unset = appendUnset(unset, branch)
+			}
+		case len(n.Filters) == 0 && isDefaultOperator(n.ExpType) && n.Default != nil:
+			if n.defaultApplies() {
+				unset = appendUnset(unset, n.Default)
+			} else if n.ExpType != itemPlus && n.ExpType != itemColonPlus {
+				unset = appendUnset(unset, n.Variable)
+			}
+		default:
+			unset = appendUnset(unset, n.Variable)
+		}
+	}
+	return unset
+}
+
+// DependencyHash returns a hex encoded SHA-256 hash of the variables referenced by
+// text and their current values, for instance as the cache key of the rendered
+// output. Every referenced variable counts, including those of defaults that do
+// not apply, an unset variable contributes a marker distinct from any value. The
+// hash does not depend on the order or the number of the references.
+func (p *Parser) DependencyHash(text string) (string, error) {
+	if p.Restrict.Preprocess != nil {
+		text = p.Restrict.Preprocess(text)
+	}
+	if err := p.build(text); err != nil {
+		return "", err
+	}
+	vars := make(map[string]*VariableNode)
+	for _, n := range p.nodes {
+		collectVariables(vars, n)
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		v := vars[name]
+		if v.isSet() {
+			h.Write([]byte(strconv.Quote(name) + "=" + strconv.Quote(v.value()) + "\n"))
+		} else {
+			h.Write([]byte(strconv.Quote(name) + " unset\n"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// collectVariables adds the variables referenced by the node n to vars, by name.
+func collectVariables(vars map[string]*VariableNode, n Node) {
+	switch n := n.(type) {
+	case *VariableNode:
+		if _, ok := vars[n.Ident]; !ok {
+			vars[n.Ident] = n
+		}
+	case *ChainNode:
+		for _, alt := range n.Alternatives {
+			collectVariables(vars, alt)
+		}
+	case *ListNode:
+		for _, piece := range n.Nodes {
+			collectVariables(vars, piece)
+		}
+	case *SubstitutionNode:
+		collectVariables(vars, n.Variable)
+		if n.Default != nil {
+			collectVariables(vars, n.Default)
+		}
+		if n.Else != nil {
+			collectVariables(vars, n.Else)
+		}
+	}
+}
+
+// Report counts how the top level variables and substitutions of a parse resolved.
+type Report struct {
+	Resolved  int // the value of the variable was used
+	Defaulted int // the variable was unset or empty and its default was used
+	Kept      int // the variable was unset and kept as written under KeepUnset
+	Unset     int // the variable was unset and substituted without a default
+	Errored   int // the evaluation failed, e.g. under NoUnset
+}
+
+// String returns a one line summary, e.g. "rendered: 12 resolved, 3 defaulted, 1 kept".
+// The unset and errored counts are only included if they are not zero.
+func (r Report) String() string {
+	s := fmt.Sprintf("rendered: %d resolved, %d defaulted, %d kept", r.Resolved, r.Defaulted, r.Kept)
+	if r.Unset > 0 {
+		s += fmt.Sprintf(", %d unset", r.Unset)
+	}
+	if r.Errored > 0 {
+		s += fmt.Sprintf(", %d errored", r.Errored)
+	}
+	return s
+}
+
+// ParseWithReport parses text like Parse and additionally reports how its top
+// level variables and substitutions resolved. The report is returned on error
+// too, it then covers the input up to the error, or up to a syntax error in
+// AllErrors mode.
+func (p *Parser) ParseWithReport(text string) (string, Report, error) {
+	var r Report
+	p.inspect, p.partial = r.record, true
+	defer func() { p.inspect, p.partial = nil, false }()
+	out, err := p.Parse(text)
+	return out, r, err
+}
+
+// record returns the function counting the variable or substitution n once it is
+// evaluated, nil for other nodes. The outcome is classified before the evaluation,
+// whose assignments must not count.
+func (r *Report) record(n Node) func(string, error) {
+	count := r.counter(n)
+	if count == nil {
+		return nil
+	}
+	return func(_ string, err error) {
+		if err != nil {
+			r.Errored++
+			return
+		}
+		*count++
+	}
+}
+
+// counter returns the count of the variable or substitution n if its evaluation
+// succeeds, nil for other nodes.
+func (r *Report) counter(n Node) *int {
+	var v *VariableNode
+	switch n := n.(type) {
+	case *VariableNode:
+		v = n
+	case *SubstitutionNode:
+		v = n.Variable
+	default:
+		return nil
+	}
+	if n, ok := n.(*SubstitutionNode); ok {
+		switch {
+		case v.kept() && (n.Default == nil || n.ExpType == itemQuestion):
+			return &r.Kept
+		case n.ExpType == itemQuestion && !v.notEmpty() && n.Else != nil:
+			return &r.Defaulted
+		case len(n.Filters) == 0 && n.Default != nil && n.ExpType != itemPlus && n.ExpType != itemColonPlus &&
+			isDefaultOperator(n.ExpType) && n.defaultApplies():
+			return &r.Defaulted
+		}
+	}
+	switch {
+	case v.isSet():
+		return &r.Resolved
+	case v.kept():
+		return &r.Kept
+	}
+	return &r.Unset
+}
+
+// Explanation describes how a variable or a substitution of the input resolved.
+type Explanation struct {
+	Expression string // source text of the expression, e.g. "${A:-${B:-c}}"
+	Branch     string // how it resolved, e.g. "A unset, B unset, used literal c"
+	Value      string // the rendered value
+}
+
+// Explain parses text like Parse and additionally explains each top level variable
+// and substitution in order of appearance, the branch descriptions follow nested
+// defaults down to the value that was used.
+func (p *Parser) Explain(text string) (string, []Explanation, error) {
+	var exps []Explanation
+	p.inspect = func(n Node) func(string, error) {
+		var expr string
+		switch n := n.(type) {
+		case *VariableNode:
+			expr = string(p.Restrict.sigil()) + n.Ident
+		case *SubstitutionNode:
+			expr = n.Source
+		default:
+			return nil
+		}
+		// explained before the evaluation, as its assignments change the branch
+		branch := p.redact(explain(n))
+		return func(value string, err error) {
+			if err != nil {
+				return
+			}
+			if referencesSecret(n) {
+				value = redacted
+			}
+			exps = append(exps, Explanation{Expression: expr, Branch: branch, Value: p.redact(value)})
+		}
+	}
+	defer func() { p.inspect = nil }()
+	out, err := p.Parse(text)
+	if err != nil {
+		return "", nil, err
+	}
+	return out, exps, nil
+}
+
+// redact replaces the values of the secret variables occurring in s, such as a
+// secret expanded in the literal text of a default.
+func (p *Parser) redact(s string) string {
+	for name := range p.Restrict.SecretVars {
+		if v := NewVariable(name, p.Env, p.Restrict); v.notEmpty() {
+			s = strings.ReplaceAll(s, v.value(), redacted)
+		}
+	}
+	return s
+}
+
+// referencesSecret reports whether the node n refers to a variable of SecretVars,
+// directly or through a default.
+func referencesSecret(n Node) bool {
+	switch n := n.(type) {
+	case *VariableNode:
+		return n.Restrict.secret(n.Ident)
+	case *SubstitutionNode:
+		return referencesSecret(n.Variable) ||
+			(n.Default != nil && referencesSecret(n.Default)) ||
+			(n.Else != nil && referencesSecret(n.Else))
+	case *ChainNode:
+		for _, alt := range n.Alternatives {
+			if referencesSecret(alt) {
+				return true
+			}
+		}
+	case *ListNode:
+		for _, piece := range n.Nodes {
+			if referencesSecret(piece) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expectedAlternative returns the alternative of the chain n expected to be used,
+// judged from the state of the variables without evaluating any node, as
+// inspecting a template must not run its filters or assignments.
+func expectedAlternative(n *ChainNode) Node {
+	last := len(n.Alternatives) - 1
+	for _, alt := range n.Alternatives[:last] {
+		if expectedNonEmpty(alt) {
+			return alt
+		}
+	}
+	return n.Alternatives[last]
+}
+
+// expectedNonEmpty reports whether the node n is expected to render a non-empty
+// value, without evaluating it. Filters and pattern operators are assumed to
+// keep a value non-empty.
+func expectedNonEmpty(n Node) bool {
+	switch n := n.(type) {
+	case *TextNode:
+		return n.Text != ""
+	case *ClockNode:
+		return true
+	case *VariableNode:
+		return n.notEmpty()
+	case *ChainNode:
+		return expectedNonEmpty(expectedAlternative(n))
+	case *ListNode:
+		for _, piece := range n.Nodes {
+			if expectedNonEmpty(piece) {
+				return true
+			}
+		}
+	case *SubstitutionNode:
+		switch {
+		case n.Variable.kept() && (n.Default == nil || n.ExpType == itemQuestion):
+			return true
+		case n.ExpType == itemQuestion:
+			branch := n.Else
+			if n.Variable.notEmpty() {
+				branch = n.Default
+			}
+			return branch != nil && expectedNonEmpty(branch)
+		case len(n.Filters) == 0 && isDefaultOperator(n.ExpType):
+			if n.defaultApplies() {
+				return n.Default != nil && expectedNonEmpty(n.Default)
+			}
+			return n.ExpType != itemPlus && n.ExpType != itemColonPlus && n.Variable.notEmpty()
+		}
+		return n.Variable.notEmpty()
+	}
+	return false
+}
+
+// explain describes how the node n resolves.
+func explain(n Node) string {
+	switch n := n.(type) {
+	case *TextNode:
+		return "used literal " + n.Text
+	case *ClockNode:
+		return "used the current time"
+	case *VariableNode:
+		if !n.isSet() {
+			return explainState(n)
+		}
+		return "used " + n.Ident
+	case *ChainNode:
+		chosen := expectedAlternative(n)
+		var skipped []string
+		for _, alt := range n.Alternatives {
+			if alt == chosen {
+				break
+			}
+			if v, ok := alt.(*VariableNode); ok {
+				skipped = append(skipped, explainState(v))
+			} else {
+				skipped = append(skipped, explain(alt))
+			}
+		}
+		return strings.Join(append(skipped, explain(chosen)), ", ")
+	case *ListNode:
+		pieces := make([]string, len(n.Nodes))
+		for i, piece := range n.Nodes {
+			pieces[i] = explain(piece)
+		}
+		return strings.Join(pieces, ", ")
+	case *SubstitutionNode:
+		state := explainState(n.Variable)
+		switch {
+		case n.Variable.kept() && (n.Default == nil || n.ExpType == itemQuestion):
+			return state + ", kept as is"
+		case len(n.Filters) > 0:
+			names := make([]string, len(n.Filters))
+			for i, f := range n.Filters {
+				names[i] = f.Name
+			}
+			return state + ", applied " + strings.Join(names, "|")
+		case patternDefinitions[n.ExpType].Operator != "":
+			return state + ", applied " + patternDefinitions[n.ExpType].Operator
+		case n.ExpType == itemQuestion:
+			branch := n.Else
+			if n.Variable.notEmpty() {
+				branch = n.Default
+			}
+			if branch == nil {
+				return state + ", used empty"
+			}
+			return state + ", " + explain(branch)
+		case n.ExpType == itemColonQuestion:
+			if !n.Variable.notEmpty() {
+				return state + ", failed"
+			}
+		case n.ExpType >= itemPlus && n.Default != nil:
+			if n.defaultApplies() {
+				return state + ", " + explain(n.Default)
+			}
+			if n.ExpType == itemPlus || n.ExpType == itemColonPlus {
+				return state + ", used empty"
+			}
+		}
+		return state
+	}
+	return ""
+}
+
+// explainState describes whether the variable v is set, empty or unset.
+func explainState(v *VariableNode) string {
+	switch {
+	case !v.isSet():
+		return v.Ident + " unset"
+	case v.value() == "":
+		return v.Ident + " empty"
+	}
+	return v.Ident + " set"
+}
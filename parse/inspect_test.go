@@ -0,0 +1,555 @@
+package parse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOperatorsUsed(t *testing.T) {
+	testCases := []struct {
+		name, input string
+		expected    []string
+		hasErr      bool
+	}{
+		{"three operators", "${A:-x} ${B^^} ${C:-y} ${D+z}", []string{":-", "^^", "+"}, false},
+		{"nested default", "${A:=${B,,}}", []string{":=", ",,"}, false},
+		{"filters", "${A|indent:2} ${B@urlencode} ${C|urlencode|indent}", []string{"|indent", "@urlencode", "|urlencode"}, false},
+		{"ternary", "${A?x:y}", []string{"?"}, false},
+		{"required", "${A:?msg} ${B:?}", []string{":?"}, false},
+		{"no operators", "$A ${B} text", nil, false},
+		{"operators in default text are not counted", "${A:-a-b+c}", []string{":-"}, false},
+		{"syntax error", "${A", nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ops, err := New("test", FakeEnv, &Restrictions{}).OperatorsUsed(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if !reflect.DeepEqual(ops, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, ops)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	testCases := []struct {
+		name, input, output string
+		expected            []Explanation
+	}{
+		{"nested default", "${NOTSET:-${UNSET:-c}}", "c", []Explanation{
+			{"${NOTSET:-${UNSET:-c}}", "NOTSET unset, UNSET unset, used literal c", "c"},
+		}},
+		{"nested default variable", "x=${EMPTY:-${NOTSET:-$BAR}}", "x=bar", []Explanation{
+			{"${EMPTY:-${NOTSET:-$BAR}}", "EMPTY empty, NOTSET unset, used BAR", "bar"},
+		}},
+		{"set variable", "$FOO ${BAR:-x}", "foo bar", []Explanation{
+			{"$FOO", "used FOO", "foo"},
+			{"${BAR:-x}", "BAR set", "bar"},
+		}},
+		{"alternate", "${EMPTY+a}${NOTSET+b}", "a", []Explanation{
+			{"${EMPTY+a}", "EMPTY empty, used literal a", "a"},
+			{"${NOTSET+b}", "NOTSET unset, used empty", ""},
+		}},
+		{"ternary and pattern", "${FOO?y:n} ${BAR^^}", "y BAR", []Explanation{
+			{"${FOO?y:n}", "FOO set, used literal y", "y"},
+			{"${BAR^^}", "BAR set, applied ^^", "BAR"},
+		}},
+		{"no substitutions", "plain", "plain", nil},
+		{"assignment", "${X:=5} $X", "5 5", []Explanation{
+			{"${X:=5}", "X unset, used literal 5", "5"},
+			{"$X", "used X", "5"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, exps, err := New("test", FakeEnv, &Restrictions{}).Explain(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.output {
+				t.Errorf("expected output %q, got %q", tc.output, out)
+			}
+			if !reflect.DeepEqual(exps, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, exps)
+			}
+		})
+	}
+}
+
+// TestExplainChain tests the explanations of chained defaults under ChainDefaults
+func TestExplainChain(t *testing.T) {
+	testCases := []struct {
+		name, input, output string
+		expected            []Explanation
+	}{
+		{"chained defaults", "${NOTSET:-$EMPTY:-$FOO:-x}", "foo", []Explanation{
+			{"${NOTSET:-$EMPTY:-$FOO:-x}", "NOTSET unset, EMPTY empty, used FOO", "foo"},
+		}},
+		{"literal last", "${NOTSET:-$EMPTY:-x}", "x", []Explanation{
+			{"${NOTSET:-$EMPTY:-x}", "NOTSET unset, EMPTY empty, used literal x", "x"},
+		}},
+		{"nested assignment", "${NOTSET:-${Q:=v}:-z}", "v", []Explanation{
+			{"${NOTSET:-${Q:=v}:-z}", "NOTSET unset, Q unset, used literal v", "v"},
+		}},
+		{"nested substitution skipped", "${NOTSET:-${EMPTY}:-z}", "z", []Explanation{
+			{"${NOTSET:-${EMPTY}:-z}", "NOTSET unset, EMPTY empty, used literal z", "z"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, exps, err := New("test", FakeEnv, &Restrictions{ChainDefaults: true}).Explain(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.output {
+				t.Errorf("expected output %q, got %q", tc.output, out)
+			}
+			if !reflect.DeepEqual(exps, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, exps)
+			}
+		})
+	}
+}
+
+func TestOnDeprecated(t *testing.T) {
+	DeprecateOperator(",,")
+	DeprecateOperator("|indent")
+	defer delete(deprecatedOperators, ",,")
+	defer delete(deprecatedOperators, "|indent")
+
+	type use struct {
+		op  string
+		pos Pos
+	}
+	var uses []use
+	r := &Restrictions{OnDeprecated: func(op string, pos Pos) { uses = append(uses, use{op, pos}) }}
+
+	result, err := New("deprecated", FakeEnv, r).Parse("${BAR,,} ${FOO^^} ${A:-${test,,}} ${BAR|urlencode|indent}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "bar FOO AAA bar"; result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+	expected := []use{{",,", 5}, {",,", 29}, {"|indent", 39}}
+	if !reflect.DeepEqual(uses, expected) {
+		t.Errorf("expected %v, got %v", expected, uses)
+	}
+
+	if _, err := New("no callback", FakeEnv, &Restrictions{}).Parse("${BAR,,}"); err != nil {
+		t.Errorf("unexpected error without callback: %v", err)
+	}
+}
+
+func TestWarnSuspicious(t *testing.T) {
+	type warning struct {
+		msg string
+		pos Pos
+	}
+	testCases := []struct {
+		name, input, expected string
+		warnings              []warning
+	}{
+		{"space before colon dash", "${BAR :-x}", "bar", []warning{{"white space before operator :- in ${BAR :-x}", 5}}},
+		{"colon without operator", "${BAR :x}", "bar", []warning{{"':' without an operator in ${BAR :x}", 5}}},
+		{"space before dash", "a ${NOTSET -x}", "a ", []warning{{"white space before operator - in ${NOTSET -x}", 10}}},
+		{"tab before pattern", "${BAR\t^^}", "bar", []warning{{"white space before operator ^^ in ${BAR\t^^}", 5}}},
+		{"nested", "${NOTSET:-${FOO :=y}}", "foo", []warning{{"white space before operator := in ${FOO :=y}", 15}}},
+		{"several", "${BAR :-x}${FOO :}", "barfoo", []warning{
+			{"white space before operator :- in ${BAR :-x}", 5},
+			{"':' without an operator in ${FOO :}", 15},
+		}},
+		{"operator", "${BAR:-x} ${NOTSET-y}", "bar y", nil},
+		{"space in default", "${NOTSET:- :-x}", " :-x", nil},
+		{"ternary", "${BAR? a : b}", " a ", nil},
+		{"no space", "${BAR%x}", "bar", nil},
+		{"space without operator", "${BAR junk}", "bar", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var warnings []warning
+			r := &Restrictions{WarnSuspicious: func(msg string, pos Pos) { warnings = append(warnings, warning{msg, pos}) }}
+			result, err := New(tc.name, FakeEnv, r).Parse(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+			if !reflect.DeepEqual(warnings, tc.warnings) {
+				t.Errorf("expected %v, got %v", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestSecretVars(t *testing.T) {
+	env := NewEnv([]string{"PASSWORD=s3cr3t%zz", "USER=admin"})
+	r := &Restrictions{SecretVars: map[string]bool{"PASSWORD": true}}
+
+	_, exps, err := New("secret", env, r).Explain("$USER:$PASSWORD ${PASSWORD^^} ${NOTSET:-pw=$PASSWORD} ${NOTSET:-${PASSWORD}}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, exp := range exps {
+		for _, s := range []string{exp.Branch, exp.Value} {
+			if strings.Contains(strings.ToLower(s), "s3cr3t") {
+				t.Errorf("%s: secret revealed in %q", exp.Expression, s)
+			}
+		}
+	}
+	if exps[0].Value != "admin" || exps[1].Value != "***" {
+		t.Errorf("expected only the secret to be redacted, got %+v", exps[:2])
+	}
+
+	_, err = New("secret", env, r).Parse("${PASSWORD@urldecode}")
+	if err == nil || strings.Contains(err.Error(), "zz") {
+		t.Errorf("expected a redacted filter error, got %v", err)
+	}
+	_, err = New("public", env, &Restrictions{}).Parse("${PASSWORD@urldecode}")
+	if err == nil || !strings.Contains(err.Error(), "zz") {
+		t.Errorf("expected the filter error of a public variable to be kept, got %v", err)
+	}
+}
+
+func TestUnsetAt(t *testing.T) {
+	testCases := []struct {
+		name, input string
+		expected    []UnsetVariable
+	}{
+		{"bare and braced", "a $NOTSET b ${UNSET2} $BAR", []UnsetVariable{{"NOTSET", 3}, {"UNSET2", 14}}},
+		{"set variables", "$BAR ${FOO^^}", nil},
+		{"multi-line", "x: $BAR\ny: ${NOPE}", []UnsetVariable{{"NOPE", 13}}},
+		{"default applies", "${NOTSET:-x}", nil},
+		{"unset default variable", "${NOTSET:-$UNSET2}", []UnsetVariable{{"UNSET2", 11}}},
+		{"nested default", "${NOTSET:-${UNSET2}}", []UnsetVariable{{"UNSET2", 12}}},
+		{"empty variable with dash", "${EMPTY-x}", nil},
+		{"alternate", "${NOTSET+x} ${NOTSET:+x}", nil},
+		{"pattern", "${NOTSET^^}", []UnsetVariable{{"NOTSET", 2}}},
+		{"filter", "${NOTSET|indent}", []UnsetVariable{{"NOTSET", 2}}},
+		{"ternary", "${NOTSET?$BAR:$UNSET2}", []UnsetVariable{{"UNSET2", 15}}},
+		{"default text variable", "${NOTSET:-x $UNSET2 $BAR}", []UnsetVariable{{"UNSET2", 13}}},
+		{"default variable and text", "${NOTSET:-$UNSET2 x ${UNSET3}}", []UnsetVariable{{"UNSET2", 11}, {"UNSET3", 22}}},
+		{"unused default text variable", "${BAR:-x $UNSET2}", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			unset, err := New("test", FakeEnv, &Restrictions{NoUnset: true}).UnsetAt(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(unset, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, unset)
+			}
+			for _, u := range unset {
+				if got := tc.input[u.Pos : int(u.Pos)+len(u.Name)]; got != u.Name {
+					t.Errorf("position %d points at %q, expected %q", u.Pos, got, u.Name)
+				}
+			}
+		})
+	}
+
+	if _, err := New("test", FakeEnv, &Restrictions{}).UnsetAt("${"); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestDependencyHash(t *testing.T) {
+	env := NewEnv([]string{"HOST=localhost", "PORT=80", "EMPTY=", "OTHER=x"})
+	text := "$HOST:${PORT:-${DEFAULT_PORT}} ${EMPTY}"
+	hash := func(text string) string {
+		t.Helper()
+		h, err := New("test", env, &Restrictions{}).DependencyHash(text)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return h
+	}
+
+	base := hash(text)
+	if len(base) != 64 {
+		t.Errorf("expected a hex encoded SHA-256, got %q", base)
+	}
+	if again := hash(text); again != base {
+		t.Errorf("expected a stable hash, got %q and %q", base, again)
+	}
+	if h := hash("${EMPTY} $HOST $HOST ${DEFAULT_PORT} ${PORT^^}"); h != base {
+		t.Error("expected the hash to depend on the referenced variables only")
+	}
+
+	env.Set("OTHER", "y")
+	if h := hash(text); h != base {
+		t.Error("expected an unreferenced variable not to change the hash")
+	}
+	env.Set("PORT", "8080")
+	changed := hash(text)
+	if changed == base {
+		t.Error("expected a referenced value to change the hash")
+	}
+	env.Set("DEFAULT_PORT", "")
+	if h := hash(text); h == changed {
+		t.Error("expected setting an unused default variable to change the hash")
+	}
+	// variables in the text of a default count too
+	env.Set("B", "1")
+	inText := hash("${HOST:-x $B}")
+	env.Set("B", "2")
+	if h := hash("${HOST:-x $B}"); h == inText {
+		t.Error("expected a variable in the text of a default to change the hash")
+	}
+	if h := hash("${HOST:-x $B}"); h != hash("$HOST $B") {
+		t.Error("expected the variables of the text of a default to be referenced")
+	}
+	unset, _ := New("test", NewEnv(nil), &Restrictions{}).DependencyHash("$EMPTY")
+	if empty := hash("$EMPTY"); unset == empty {
+		t.Error("expected unset and empty variables to hash differently")
+	}
+
+	if _, err := New("test", env, &Restrictions{}).DependencyHash("${"); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestParseWithReport(t *testing.T) {
+	testCases := []struct {
+		name, input string
+		restrict    *Restrictions
+		expected    Report
+		hasErr      bool
+	}{
+		{"mixed", "$BAR ${FOO} ${NOTSET:-x} ${EMPTY:-y} ${BAR:-z} $NOTSET text", &Restrictions{},
+			Report{Resolved: 3, Defaulted: 2, Unset: 1}, false},
+		{"kept", "$BAR $NOTSET ${NOTSET2} ${NOTSET3^^} ${NOTSET:-x}", &Restrictions{KeepUnset: true},
+			Report{Resolved: 1, Defaulted: 1, Kept: 3}, false},
+		{"alternate and ternary", "${BAR:+x} ${NOTSET:+x} ${BAR?a:b} ${NOTSET?a:b} ${NOTSET?a}", &Restrictions{},
+			Report{Resolved: 2, Defaulted: 1, Unset: 2}, false},
+		{"set but empty", "$EMPTY ${EMPTY-x}", &Restrictions{},
+			Report{Resolved: 2}, false},
+		{"errored", "$BAR $NOTSET ${NOTSET2} ${NOTSET:-x}", &Restrictions{NoUnset: true},
+			Report{Resolved: 1, Defaulted: 1, Errored: 2}, true},
+		{"no variables", "plain text", &Restrictions{}, Report{}, false},
+		{"assignment", "${X:=5}", &Restrictions{}, Report{Defaulted: 1}, false},
+		{"assignment then reference", "${X:=5} $X ${X:-y}", &Restrictions{}, Report{Resolved: 2, Defaulted: 1}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := New("test", FakeEnv, tc.restrict)
+			p.Mode = AllErrors
+			_, report, err := p.ParseWithReport(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if report != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, report)
+			}
+		})
+	}
+
+	report := Report{Resolved: 12, Defaulted: 3, Kept: 1}
+	if expected := "rendered: 12 resolved, 3 defaulted, 1 kept"; report.String() != expected {
+		t.Errorf("expected %q, got %q", expected, report.String())
+	}
+	report.Unset, report.Errored = 2, 1
+	if expected := "rendered: 12 resolved, 3 defaulted, 1 kept, 2 unset, 1 errored"; report.String() != expected {
+		t.Errorf("expected %q, got %q", expected, report.String())
+	}
+}
+
+// TestAssignmentsDropped tests that the assignments of a parse are not seen by
+// the later uses of the parser
+func TestAssignmentsDropped(t *testing.T) {
+	fresh, err := New("fresh", FakeEnv, &Restrictions{}).DependencyHash("$Y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := New("reused", FakeEnv, &Restrictions{})
+	if out, err := p.Parse("${Y:=5}"); err != nil || out != "5" {
+		t.Fatalf("expected %q, got %q, %v", "5", out, err)
+	}
+	if unset, err := p.UnsetAt("$Y"); err != nil || !reflect.DeepEqual(unset, []UnsetVariable{{"Y", 1}}) {
+		t.Errorf("expected Y unset, got %v, %v", unset, err)
+	}
+	if hash, err := p.DependencyHash("$Y"); err != nil || hash != fresh {
+		t.Errorf("expected the hash of a fresh parser, got %v", err)
+	}
+	if out, err := p.Parse("[$Y]"); err != nil || out != "[]" {
+		t.Errorf("expected %q, got %q, %v", "[]", out, err)
+	}
+	if _, report, err := p.ParseWithReport("${Y:=5}"); err != nil || report != (Report{Defaulted: 1}) {
+		t.Errorf("expected a defaulted report, got %+v, %v", report, err)
+	}
+	if _, exps, err := p.Explain("${Y:=5}"); err != nil || len(exps) != 1 || exps[0].Branch != "Y unset, used literal 5" {
+		t.Errorf("expected Y unset, got %+v, %v", exps, err)
+	}
+
+	// sequential inspections, and nodes evaluated outside of a parse, assign nothing
+	p = New("inspected", FakeEnv, &Restrictions{ChainDefaults: true})
+	for _, input := range []string{"${NOTSET:-${Q:=v}:-z}", "${Q:=v}"} {
+		if _, err := p.UnsetAt(input); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.DependencyHash(input); err != nil {
+			t.Fatal(err)
+		}
+		if unset, err := p.UnsetAt("$Q"); err != nil || !reflect.DeepEqual(unset, []UnsetVariable{{"Q", 1}}) {
+			t.Errorf("%q: expected Q unset, got %v, %v", input, unset, err)
+		}
+	}
+	if err := p.build("${Q:=v}"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := p.nodes[0].String(); err != nil || s != "v" {
+		t.Fatalf("expected %q, got %q, %v", "v", s, err)
+	}
+	if unset, err := p.UnsetAt("$Q"); err != nil || !reflect.DeepEqual(unset, []UnsetVariable{{"Q", 1}}) {
+		t.Errorf("expected Q unset after an evaluation outside of a parse, got %v, %v", unset, err)
+	}
+}
+
+// TestInspectEvaluatesOnce tests that reports and explanations do not evaluate
+// the substitutions again
+func TestInspectEvaluatesOnce(t *testing.T) {
+	calls := 0
+	RegisterFilter("counted", func(ctx *FilterContext, value string, args []string) (string, error) {
+		calls++
+		return value, nil
+	})
+	defer delete(filterDefinitions, "counted")
+	slow := &mapResolver{vars: map[string]string{"SLOW": "s"}}
+	p := New("once", NewEnv(nil), &Restrictions{Resolvers: []Resolver{slow}, ChainDefaults: true})
+
+	if _, _, err := p.ParseWithReport("${SLOW|counted} $SLOW"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Explain("${SLOW|counted} $SLOW"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || slow.lookups != 2 {
+		t.Errorf("expected 2 filter calls and 2 lookups, got %d and %d", calls, slow.lookups)
+	}
+
+	// the alternatives of a chain too
+	calls = 0
+	if _, _, err := p.ParseWithReport("${NONE:-${SLOW|counted}:-x}"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Explain("${NONE:-${SLOW|counted}:-x}"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 filter calls in chains, got %d", calls)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	testCases := []struct {
+		name, input string
+		restrict    *Restrictions
+		expected    []string
+	}{
+		{"references in order", "$B ${A} $B ${C:-$D}", &Restrictions{}, []string{"B", "A", "B", "C", "D"}},
+		{"escaped", "$$A $B", &Restrictions{}, []string{"B"}},
+		{"none", "plain", &Restrictions{}, nil},
+		{"GNU", "$B ${A} ${C:-$D} $$E", &Restrictions{GNUCompat: true}, []string{"B", "A", "D", "E"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			names, err := New("test", FakeEnv, tc.restrict).Variables(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, names)
+			}
+		})
+	}
+
+	if _, err := New("test", FakeEnv, &Restrictions{}).Variables("${"); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestRequiredVariables(t *testing.T) {
+	testCases := []struct {
+		name, input        string
+		required, optional []string
+	}{
+		{"mixed", "host=$HOST port=${PORT:-80} user=${USER} debug=${DEBUG:+-v}", []string{"HOST", "USER"}, []string{"DEBUG", "PORT"}},
+		{"variable in default", "${A:-$B} ${C-${D}}", nil, []string{"A", "B", "C", "D"}},
+		{"variable in default text", "${A:-x $B y}", nil, []string{"A", "B"}},
+		{"required elsewhere", "${A:-$B} $B", []string{"B"}, []string{"A"}},
+		{"ternary", "${A?$B:$C}", nil, []string{"A", "B", "C"}},
+		{"nested in default", "${A:-${B:-$C}} ${D:-${E}}", nil, []string{"A", "B", "C", "D", "E"}},
+		{"pattern and filter", "${A^^} ${B,,} ${C|pad:$N} ${D/x/$M}", []string{"A", "B", "C", "D"}, nil},
+		{"assignment", "${X:=1} $X ${Y=$Z}", nil, []string{"X", "Y", "Z"}},
+		{"assignment after use", "$X ${X:=1}", []string{"X"}, nil},
+		{"conditional assignment", "${A:-${X:=1}} $X", []string{"X"}, []string{"A"}},
+		{"escaped", "$$A ${B:-$$C}", nil, []string{"B"}},
+		{"none", "plain", nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			required, optional, err := New("test", FakeEnv, &Restrictions{}).RequiredVariables(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(required, tc.required) {
+				t.Errorf("required: expected %q, got %q", tc.required, required)
+			}
+			if !reflect.DeepEqual(optional, tc.optional) {
+				t.Errorf("optional: expected %q, got %q", tc.optional, optional)
+			}
+		})
+	}
+
+	if _, _, err := New("test", FakeEnv, &Restrictions{}).RequiredVariables("${A"); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
+
+func TestParseCollect(t *testing.T) {
+	testCases := []struct {
+		name, input, expected string
+		missing               []string
+	}{
+		{"mixed", "a=$BAR b=${NOTSET} c=$UNSET2 d=$NOTSET", "a=bar b= c= d=", []string{"NOTSET", "UNSET2"}},
+		{"defaults", "${NOTSET:-x} ${NOTSET2:-$UNSET3}", "x ", []string{"UNSET3"}},
+		{"empty is not missing", "[$EMPTY]", "[]", nil},
+		{"assigned", "${X:=1} $X", "1 1", nil},
+		{"none", "plain", "plain", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := New("test", FakeEnv, &Restrictions{NoUnset: true, NoEmpty: true, Required: true})
+			out, missing, err := p.ParseCollect(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, out)
+			}
+			if !reflect.DeepEqual(missing, tc.missing) {
+				t.Errorf("expected missing %q, got %q", tc.missing, missing)
+			}
+		})
+	}
+
+	p := New("test", FakeEnv, &Restrictions{NoUnset: true})
+	if _, _, err := p.ParseCollect("$BAR ${"); err == nil {
+		t.Error("expected a syntax error")
+	}
+	if _, err := p.Parse("$NOTSET"); err == nil {
+		t.Error("expected the parser restrictions to be untouched")
+	}
+}
@@ -2,6 +2,7 @@ package parse
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -33,18 +34,24 @@ const (
 	eof                = -1
 	itemError itemType = iota // error occurred; value is text of error
 	itemEOF
-	itemText        // plain text
-	itemPlus        // plus('+')
-	itemDash        // dash('-')
-	itemEquals      // equals
-	itemColonEquals // colon-equals (':=')
-	itemColonDash   // colon-dash(':-')
-	itemColonPlus   // colon-plus(':+')
-	itemCaretCaret  // caret-caret('^^') for uppercase conversion
-	itemCommaComma  // comma-comma(',,') for lowercase conversion
-	itemVariable    // variable starting with '$', such as '$hello' or '$1'
-	itemLeftDelim   // left action delimiter '${'
-	itemRightDelim  // right action delimiter '}'
+	itemText          // plain text
+	itemPlus          // plus('+')
+	itemDash          // dash('-')
+	itemEquals        // equals
+	itemColonEquals   // colon-equals (':=')
+	itemColonDash     // colon-dash(':-')
+	itemColonPlus     // colon-plus(':+')
+	itemColonQuestion // colon-question(':?') failing on an unset or empty variable
+	itemCaretCaret    // caret-caret('^^') for uppercase conversion
+	itemCommaComma    // comma-comma(',,') for lowercase conversion
+	itemQuestion      // question('?') for the ternary expansion '${VAR?set:unset}'
+	itemPipe          // pipe('|') starting the filters of '${VAR|filter:arg}'
+	itemAt            // at('@') starting the operator of '${VAR@operator}'
+	itemSlash         // slash('/') for replacing the first match '${VAR/pattern/string}'
+	itemSlashSlash    // slash-slash('//') for replacing all matches '${VAR//pattern/string}'
+	itemVariable      // variable starting with '$', such as '$hello' or '$1'
+	itemLeftDelim     // left action delimiter '${'
+	itemRightDelim    // right action delimiter '}'
 )
 
 var tokens = map[itemType]string{
@@ -63,24 +70,54 @@ type stateFn func(*lexer) stateFn
 // recognized as a valid variable token during lexing. When a variable is encountered
 // (e.g., $VAR or ${VAR}), the matcher is called with the variable name (without the $ prefix).
 // If the matcher returns false, the variable is treated as plain text instead of a variable token.
-// A nil matcher accepts all variables except underscore ("_") which is always rejected.
+// A nil matcher accepts all variables except underscore ("_") which is rejected
+// unless Restrictions.AllowUnderscoreVar is set.
 type varMatcher func(variable string) bool
 
+// MatchRegexp returns a varMatcher accepting the variable names matched by the
+// regular expression pattern, for use as Restrictions.VarMatcher. The pattern is
+// compiled once, an invalid pattern is reported as error.
+func MatchRegexp(pattern string) (varMatcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
 // lexer holds the state of the scanner
 type lexer struct {
-	input     string     // the string being lexed
-	state     stateFn    // the next lexing function to enter
-	pos       Pos        // current position in the input
-	start     Pos        // start position of this item
-	width     Pos        // width of last rune read from input
-	lastPos   Pos        // position of most recent item returned by nextItem
-	items     chan item  // channel of lexed items
-	subsDepth int        // depth of substitution
-	noDigit   bool       // if the lexer skips variables that start with a digit
-	matcher   varMatcher // optional variable filter; when non-nil, determines which variables are tokenized vs treated as text
+	input           string     // the string being lexed
+	state           stateFn    // the next lexing function to enter
+	pos             Pos        // current position in the input
+	start           Pos        // start position of this item
+	width           Pos        // width of last rune read from input
+	lastPos         Pos        // position of most recent item returned by nextItem
+	items           chan item  // channel of lexed items
+	subsDepth       int        // depth of substitution
+	noDigit         bool       // if the lexer skips variables that start with a digit
+	matcher         varMatcher // optional variable filter; when non-nil, determines which variables are tokenized vs treated as text
+	varStart        runeClass  // reports whether a rune may start a variable name
+	varPart         runeClass  // reports whether a rune may continue a variable name
+	allowUnderscore bool       // if "_" is accepted as a variable name
+	sigil           rune       // the rune introducing variables, '$' by default
+	doubleBrace     bool       // if "}}" in the outermost substitution is a literal '}'
+	colonInName     bool       // if a ':' followed by a name rune continues a name in braces
+	rawDelims       [2]string  // delimiters of verbatim regions, disabled if either is empty
+	gnu             bool       // if only $VAR and ${VAR} are recognized, as by GNU envsubst
+	maxName         int        // maximum length of a variable name in runes, unlimited if zero
+	strictName      bool       // if a name longer than maxName is an error instead of text
+	noEscape        bool       // if "$$" is not an escaped '$'
+	recover         bool       // if lexing goes on after an error, see errorf
+	subsStart       Pos        // start position of the outermost substitution
 }
 
-// next returns the next rune in the input.
+// runeClass is a predicate used by the lexer to classify runes of variable names.
+type runeClass func(r rune) bool
+
+// next returns the next rune in the input. An invalid UTF-8 byte is returned as
+// utf8.RuneError of width 1, items are slices of the input so its bytes are
+// still passed through unchanged.
 func (l *lexer) next() rune {
 	if int(l.pos) >= len(l.input) {
 		l.width = 0
@@ -118,9 +155,25 @@ func (l *lexer) ignore() {
 
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
+// When recovering, an error inside a substitution is followed by the opening
+// delimiter of the outermost substitution as text and the scan resumes right
+// after it, so the errors of the rest of the input are reported too. Any other
+// error is followed by EOF.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 	l.items <- item{itemError, l.start, fmt.Sprintf(format, args...)}
-	return nil
+	if !l.recover {
+		return nil
+	}
+	if l.subsDepth == 0 {
+		l.start = l.pos
+		l.emit(itemEOF)
+		return nil
+	}
+	l.subsDepth = 0
+	l.start = l.subsStart
+	l.pos = l.subsStart + Pos(len(l.leftDelim()))
+	l.emit(itemText)
+	return lexText
 }
 
 // nextItem returns the next item from the input.
@@ -130,21 +183,73 @@ func (l *lexer) nextItem() item {
 	return item
 }
 
-// lex creates a new scanner for the input string.
-func lex(input string, noDigit bool, matcher varMatcher) *lexer {
+// leftDelim returns the opening delimiter of a substitution, "${" by default.
+func (l *lexer) leftDelim() string {
+	return string(l.sigil) + "{"
+}
+
+// drain consumes the remaining items so the lexing goroutine can exit.
+// Called by the parser, not in the lexing goroutine.
+func (l *lexer) drain() {
+	for range l.items {
+	}
+}
+
+// lex creates a new scanner for the input string, configured by the lexer
+// related options of r. A nil r lexes with the default rules.
+func lex(input string, r *Restrictions) *lexer {
 	l := &lexer{
-		input:   input,
-		items:   make(chan item),
-		noDigit: noDigit,
-		matcher: matcher,
+		input:    input,
+		items:    make(chan item),
+		varStart: isAlphaNumeric,
+		varPart:  isAlphaNumeric,
+		sigil:    '$',
+	}
+	if r != nil {
+		l.noDigit = r.NoDigit
+		l.matcher = r.VarMatcher
+		if r.IsVarStart != nil {
+			l.varStart = r.IsVarStart
+		}
+		if r.IsVarPart != nil {
+			l.varPart = r.IsVarPart
+		}
+		l.allowUnderscore = r.AllowUnderscoreVar
+		l.sigil = r.sigil()
+		l.doubleBrace = r.DoubleBraceEscape
+		l.colonInName = r.ColonInName
+		if r.RawDelims[0] != "" && r.RawDelims[1] != "" {
+			l.rawDelims = r.RawDelims
+		}
+		l.gnu = r.GNUCompat
+		l.maxName = r.MaxNameLength
+		l.strictName = r.StrictNameLength
+		l.noEscape = r.NoDollarEscape
+		l.recover = r.recover
 	}
 	go l.run()
 	return l
 }
 
+// restart returns a new scanner with the configuration of l scanning its input
+// from pos, the positions of the items stay relative to the whole input.
+// l must be drained first.
+func (l *lexer) restart(pos Pos) *lexer {
+	n := *l
+	n.items = make(chan item)
+	n.pos, n.start, n.lastPos, n.width = pos, pos, pos, 0
+	n.subsDepth = 0
+	go n.run()
+	return &n
+}
+
 // run runs the state machine for the lexer.
 func (l *lexer) run() {
-	for l.state = lexText; l.state != nil; {
+	l.state = lexText
+	if l.gnu {
+		l.state = lexGNUText
+	}
+	for l.state != nil {
 		l.state = l.state(l)
 	}
 	close(l.items)
@@ -154,20 +259,26 @@ func (l *lexer) run() {
 func lexText(l *lexer) stateFn {
 Loop:
 	for {
+		if l.rawDelims[0] != "" && strings.HasPrefix(l.input[l.pos:], l.rawDelims[0]) {
+			if l.pos > l.start {
+				l.emit(itemText)
+			}
+			return lexRaw
+		}
 		switch r := l.next(); r {
-		case '$':
-			l.pos--
+		case l.sigil:
+			l.backup()
 			// emit the text we've found until here, if any.
 			if l.pos > l.start {
 				l.emit(itemText)
 			}
-			l.pos++
+			l.next()
 			switch r := l.peek(); {
 			case l.noDigit && unicode.IsDigit(r):
 				// ignore variable starting with digit like $1.
 				l.next()
 				l.emit(itemText)
-			case r == '$':
+			case r == l.sigil && !l.noEscape:
 				// ignore the previous '$'.
 				l.ignore()
 				l.next()
@@ -181,10 +292,11 @@ Loop:
 					l.emit(itemText)
 					break
 				}
+				l.subsStart = l.start
 				l.subsDepth++
 				l.emit(itemLeftDelim)
 				return lexSubstitutionOperator
-			case isAlphaNumeric(r):
+			case l.varStart(r):
 				return lexVariable
 			}
 		case eof:
@@ -199,36 +311,152 @@ Loop:
 	return nil
 }
 
+// lexGNUText scans the input under Restrictions.GNUCompat, recognizing $VAR and
+// ${VAR} only, where names are made of ASCII letters, digits and underscores and
+// do not start with a digit. Everything else, including "$$" and ${VAR:-x}, is
+// text, as written by GNU envsubst.
+func lexGNUText(l *lexer) stateFn {
+	for {
+		i := strings.IndexByte(l.input[l.pos:], '$')
+		if i < 0 {
+			break
+		}
+		l.pos += Pos(i)
+		dollar := l.pos
+		l.pos++
+		braced := strings.HasPrefix(l.input[l.pos:], "{")
+		if braced {
+			l.pos++
+		}
+		name := l.pos
+		if l.pos < Pos(len(l.input)) && isGNUNameStart(l.input[l.pos]) {
+			for l.pos++; l.pos < Pos(len(l.input)) && isGNUNamePart(l.input[l.pos]); l.pos++ {
+			}
+		}
+		v := l.input[name:l.pos]
+		if l.tooLong(v) && l.strictName {
+			l.start = dollar
+			return l.errorf("variable name longer than %d characters", l.maxName)
+		}
+		if v == "" || l.tooLong(v) || (braced && !strings.HasPrefix(l.input[l.pos:], "}")) || (l.matcher != nil && !l.matcher(v)) {
+			// not a variable, scan on after the '$'
+			l.pos = dollar + 1
+			continue
+		}
+		if dollar > l.start {
+			end := l.pos
+			l.pos = dollar
+			l.emit(itemText)
+			l.pos = end
+		}
+		if !braced {
+			l.emit(itemVariable)
+			continue
+		}
+		end := l.pos
+		l.pos = name
+		l.emit(itemLeftDelim)
+		l.pos = end
+		l.emit(itemVariable)
+		l.pos++
+		l.emit(itemRightDelim)
+	}
+	l.pos = Pos(len(l.input))
+	if l.pos > l.start {
+		l.emit(itemText)
+	}
+	l.emit(itemEOF)
+	return nil
+}
+
+// isGNUNameStart reports whether c may start a variable name under GNUCompat.
+func isGNUNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// isGNUNamePart reports whether c may continue a variable name under GNUCompat.
+func isGNUNamePart(c byte) bool {
+	return isGNUNameStart(c) || ('0' <= c && c <= '9')
+}
+
+// lexRaw scans a raw region, whose content is emitted as text without its delimiters.
+// The opening delimiter is known to be present.
+func lexRaw(l *lexer) stateFn {
+	l.pos += Pos(len(l.rawDelims[0]))
+	l.ignore()
+	i := strings.Index(l.input[l.pos:], l.rawDelims[1])
+	if i < 0 {
+		return l.errorf("unterminated raw region")
+	}
+	l.pos += Pos(i)
+	if l.pos > l.start {
+		l.emit(itemText)
+	}
+	l.pos += Pos(len(l.rawDelims[1]))
+	l.ignore()
+	return lexText
+}
+
 // lexVariable scans a Variable: $Alphanumeric.
 // The $ has been scanned.
 func lexVariable(l *lexer) stateFn {
+	// the name right after '${' does not start with the sigil
+	braced := l.subsDepth > 0 && !strings.HasPrefix(l.input[l.start:], string(l.sigil))
 	var r rune
 	for {
 		r = l.next()
-		if !isAlphaNumeric(r) {
+		if r == ':' && braced && l.colonInName && l.namespaced() {
+			continue
+		}
+		if !l.varPart(r) {
 			l.backup()
 			break
 		}
 	}
 	v := l.input[l.start:l.pos]
-	if v[0] == '$' {
-		v = v[1:]
+	// only the name right after '${' may be followed by an operator,
+	// a $VAR inside a default value is followed by more default text.
+	next := lexSubstitutionOperator
+	if strings.HasPrefix(v, string(l.sigil)) {
+		v = v[utf8.RuneLen(l.sigil):]
+		next = lexSubstitution
+	}
+	if l.tooLong(v) && l.strictName {
+		return l.errorf("variable name longer than %d characters", l.maxName)
 	}
-	if v == "_" || (l.matcher != nil && !l.matcher(v)) {
+	// a lone '$' such as in ${X:-$} is literal text
+	if v == "" || (v == "_" && !l.allowUnderscore) || l.tooLong(v) || (l.matcher != nil && !l.matcher(v)) {
 		// If the variable doesn't match, emit as text
 		l.emit(itemText)
 		if l.subsDepth > 0 {
-			return lexSubstitutionOperator
+			return next
 		}
 		return lexText
 	}
 	l.emit(itemVariable)
 	if l.subsDepth > 0 {
-		return lexSubstitutionOperator
+		return next
 	}
 	return lexText
 }
 
+// tooLong reports whether the variable name v exceeds the maximum name length.
+func (l *lexer) tooLong(v string) bool {
+	return l.maxName > 0 && utf8.RuneCountInString(v) > l.maxName
+}
+
+// namespaced reports whether the ':' just scanned continues a name, which is
+// the case when it is followed by a name rune that does not complete one of
+// the :-, := or :+ operators.
+func (l *lexer) namespaced() bool {
+	switch r := l.peek(); r {
+	case '-', '=', '+':
+		return false
+	default:
+		return l.varPart(r)
+	}
+}
+
 // lexSubstitutionOperator scans a starting substitution operator (if any) and continues with lexSubstitution
 func lexSubstitutionOperator(l *lexer) stateFn {
 	switch r := l.next(); {
@@ -241,7 +469,7 @@ func lexSubstitutionOperator(l *lexer) stateFn {
 		return lexText
 	case r == eof || isEndOfLine(r):
 		return l.errorf("closing brace expected")
-	case isAlphaNumeric(r) && strings.HasPrefix(l.input[l.lastPos:], "${"):
+	case l.varStart(r) && strings.HasPrefix(l.input[l.lastPos:], l.leftDelim()):
 		return lexVariable
 	case r == '+':
 		l.emit(itemPlus)
@@ -249,6 +477,19 @@ func lexSubstitutionOperator(l *lexer) stateFn {
 		l.emit(itemDash)
 	case r == '=':
 		l.emit(itemEquals)
+	case r == '?':
+		l.emit(itemQuestion)
+	case r == '|':
+		l.emit(itemPipe)
+	case r == '@':
+		l.emit(itemAt)
+	case r == '/':
+		if l.peek() == '/' {
+			l.next() // consume the second '/'
+			l.emit(itemSlashSlash)
+		} else {
+			l.emit(itemSlash)
+		}
 	case r == '^':
 		if l.peek() == '^' {
 			l.next() // consume the second '^'
@@ -271,6 +512,12 @@ func lexSubstitutionOperator(l *lexer) stateFn {
 			l.emit(itemColonEquals)
 		case '+':
 			l.emit(itemColonPlus)
+		case '?':
+			l.emit(itemColonQuestion)
+		default:
+			// a bare ':' such as ${VAR:} or ${VAR: } is not a supported expansion.
+			l.backup()
+			return l.errorf("bad substitution: operator expected after ':'")
 		}
 	}
 	return lexSubstitution
@@ -279,6 +526,11 @@ func lexSubstitutionOperator(l *lexer) stateFn {
 // lexSubstitution scans the elements inside substitution delimiters.
 func lexSubstitution(l *lexer) stateFn {
 	switch r := l.next(); {
+	case r == '}' && l.doubleBrace && l.subsDepth == 1 && l.peek() == '}':
+		// "}}" is an escaped '}', drop the second one.
+		l.emit(itemText)
+		l.next()
+		l.ignore()
 	case r == '}':
 		l.subsDepth--
 		l.emit(itemRightDelim)
@@ -288,9 +540,22 @@ func lexSubstitution(l *lexer) stateFn {
 		return lexText
 	case r == eof || isEndOfLine(r):
 		return l.errorf("closing brace expected")
-	case isAlphaNumeric(r) && strings.HasPrefix(l.input[l.lastPos:], "${"):
+	case l.varStart(r) && strings.HasPrefix(l.input[l.lastPos:], l.leftDelim()):
 		fallthrough
-	case r == '$':
+	case r == l.sigil:
+		if r == l.sigil && l.peek() == l.sigil && !l.noEscape {
+			// "$$" is an escaped '$' in default values too, ignore the first one.
+			l.ignore()
+			l.next()
+			l.emit(itemText)
+			return lexSubstitution
+		}
+		if r == l.sigil && l.noDigit && unicode.IsDigit(l.peek()) {
+			// ignore variable starting with digit like $1, as in lexText.
+			l.next()
+			l.emit(itemText)
+			return lexSubstitution
+		}
 		// Check if this is the start of a nested substitution
 		if l.peek() == '{' {
 			l.next() // consume the '{'
@@ -305,6 +570,11 @@ func lexSubstitution(l *lexer) stateFn {
 			l.emit(itemLeftDelim)
 			return lexSubstitutionOperator
 		}
+		if r == l.sigil && !l.varStart(l.peek()) {
+			// not a variable, the '$' is text as in lexText.
+			l.emit(itemText)
+			return lexSubstitution
+		}
 		return lexVariable
 	default:
 		l.emit(itemText)
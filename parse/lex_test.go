@@ -3,6 +3,7 @@ package parse
 import (
 	"strings"
 	"testing"
+	"unicode"
 )
 
 type lexTest struct {
@@ -28,6 +29,7 @@ var (
 	tColPlus    = item{itemColonPlus, 0, ":+"}
 	tCaretCaret = item{itemCaretCaret, 0, "^^"}
 	tCommaComma = item{itemCommaComma, 0, ",,"}
+	tQuestion   = item{itemQuestion, 0, "?"}
 	tLeft       = item{itemLeftDelim, 0, "${"}
 	tRight      = item{itemRightDelim, 0, "}"}
 )
@@ -42,6 +44,38 @@ var lexTests = []lexTest{
 		{itemVariable, 0, "$hello"},
 		tEOF,
 	}},
+	{"greedy var", "$HOSTNAME/$HOST", []item{
+		{itemVariable, 0, "$HOSTNAME"},
+		{itemText, 0, "/"},
+		{itemVariable, 0, "$HOST"},
+		tEOF,
+	}},
+	{"greedy var with digits", "$HOST_1.x", []item{
+		{itemVariable, 0, "$HOST_1"},
+		{itemText, 0, ".x"},
+		tEOF,
+	}},
+	{"braces bound var", "${HOST}NAME", []item{
+		tLeft,
+		{itemVariable, 0, "HOST"},
+		tRight,
+		{itemText, 0, "NAME"},
+		tEOF,
+	}},
+	{"braces bound var before digits", "${HOST}123", []item{
+		tLeft,
+		{itemVariable, 0, "HOST"},
+		tRight,
+		{itemText, 0, "123"},
+		tEOF,
+	}},
+	{"braces bound var before underscore", "${PREFIX}_table", []item{
+		tLeft,
+		{itemVariable, 0, "PREFIX"},
+		tRight,
+		{itemText, 0, "_table"},
+		tEOF,
+	}},
 	{"single char var", "${A}", []item{
 		tLeft,
 		{itemVariable, 0, "A"},
@@ -119,6 +153,16 @@ var lexTests = []lexTest{
 		{itemVariable, 0, "world"},
 		{itemError, 0, "closing brace expected"},
 	}},
+	{"bare colon", "${VAR:}", []item{
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		{itemError, 0, "bad substitution: operator expected after ':'"},
+	}},
+	{"bare colon with space", "${VAR: }", []item{
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		{itemError, 0, "bad substitution: operator expected after ':'"},
+	}},
 	{"escaping $$var", "hello $$HOME", []item{
 		{itemText, 0, "hello "},
 		{itemText, 7, "$"},
@@ -131,6 +175,24 @@ var lexTests = []lexTest{
 		{itemText, 8, "{HOME}"},
 		tEOF,
 	}},
+	{"escaping $$ at EOF", "a$$", []item{
+		{itemText, 0, "a"},
+		{itemText, 2, "$"},
+		tEOF,
+	}},
+	{"escaping $$$ at EOF", "$$$", []item{
+		{itemText, 1, "$"},
+		{itemText, 2, "$"},
+		tEOF,
+	}},
+	{"lone $ in default", "${A:-$}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		tColDash,
+		{itemText, 0, "$"},
+		tRight,
+		tEOF,
+	}},
 	{"no digit $1", "hello $1", []item{
 		{itemText, 0, "hello "},
 		{itemText, 7, "$1"},
@@ -154,6 +216,32 @@ var lexTests = []lexTest{
 		{itemText, 10, "ABC}"},
 		tEOF,
 	}},
+	{"no digit $5 in default", "${X:-$5}", []item{
+		tLeft,
+		{itemVariable, 0, "X"},
+		tColDash,
+		{itemText, 0, "$5"},
+		tRight,
+		tEOF,
+	}},
+	{"dollar before space in default", "${X:-$ }", []item{
+		tLeft,
+		{itemVariable, 0, "X"},
+		tColDash,
+		{itemText, 0, "$"},
+		{itemText, 0, " "},
+		tRight,
+		tEOF,
+	}},
+	{"dollar before punctuation in default", "${X:-$-}", []item{
+		tLeft,
+		{itemVariable, 0, "X"},
+		tColDash,
+		{itemText, 0, "$"},
+		{itemText, 0, "-"},
+		tRight,
+		tEOF,
+	}},
 	{"uppercase conversion ^^", "${VAR^^}", []item{
 		tLeft,
 		{itemVariable, 0, "VAR"},
@@ -168,6 +256,35 @@ var lexTests = []lexTest{
 		tRight,
 		tEOF,
 	}},
+	{"ternary", "${VAR?a:b}", []item{
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		tQuestion,
+		{itemText, 0, "a"},
+		{itemText, 0, ":"},
+		{itemText, 0, "b"},
+		tRight,
+		tEOF,
+	}},
+	{"ternary with variables", "${VAR?$A:$B}", []item{
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		tQuestion,
+		{itemVariable, 0, "$A"},
+		{itemText, 0, ":"},
+		{itemVariable, 0, "$B"},
+		tRight,
+		tEOF,
+	}},
+	{"escaped dollar in default", "${VAR:-$$5}", []item{
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		tColDash,
+		{itemText, 0, "$"},
+		{itemText, 0, "5"},
+		tRight,
+		tEOF,
+	}},
 	{"single caret as text", "${VAR^}", []item{
 		tLeft,
 		{itemVariable, 0, "VAR"},
@@ -182,6 +299,45 @@ var lexTests = []lexTest{
 		tRight,
 		tEOF,
 	}},
+	{"brace after substitution", "text ${VAR}}", []item{
+		{itemText, 0, "text "},
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		tRight,
+		{itemText, 0, "}"},
+		tEOF,
+	}},
+	{"braces after substitution", "${VAR}}}", []item{
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		tRight,
+		{itemText, 0, "}}"},
+		tEOF,
+	}},
+	{"brace before substitution", "}${VAR}", []item{
+		{itemText, 0, "}"},
+		tLeft,
+		{itemVariable, 0, "VAR"},
+		tRight,
+		tEOF,
+	}},
+	{"brace after variable", "}$VAR}", []item{
+		{itemText, 0, "}"},
+		{itemVariable, 0, "$VAR"},
+		{itemText, 0, "}"},
+		tEOF,
+	}},
+	{"brace after nested substitution", "${A:-${B}}}", []item{
+		tLeft,
+		{itemVariable, 0, "A"},
+		tColDash,
+		tLeft,
+		{itemVariable, 0, "B"},
+		tRight,
+		tRight,
+		{itemText, 0, "}"},
+		tEOF,
+	}},
 }
 
 func TestLex(t *testing.T) {
@@ -196,7 +352,7 @@ func TestLex(t *testing.T) {
 // collect gathers the emitted items into a slice.
 func collect(t *lexTest) (items []item) {
 	noDigit := strings.HasPrefix(t.name, "no digit")
-	l := lex(t.input, noDigit, nil)
+	l := lex(t.input, &Restrictions{NoDigit: noDigit})
 	for {
 		item := l.nextItem()
 		items = append(items, item)
@@ -210,7 +366,7 @@ func collect(t *lexTest) (items []item) {
 // collectWithMatcher gathers the emitted items into a slice using a custom matcher.
 func collectWithMatcher(t *lexTest, matcher varMatcher) (items []item) {
 	noDigit := strings.HasPrefix(t.name, "no digit")
-	l := lex(t.input, noDigit, matcher)
+	l := lex(t.input, &Restrictions{NoDigit: noDigit, VarMatcher: matcher})
 	for {
 		item := l.nextItem()
 		items = append(items, item)
@@ -388,6 +544,71 @@ func TestLexMatcherEdgeCases(t *testing.T) {
 			{itemText, 0, "$_"},
 			tEOF,
 		}},
+		{"rejected var before accepted var", "$FOO$BAR", func(v string) bool {
+			return v != "FOO"
+		}, []item{
+			{itemText, 0, "$FOO"},
+			{itemVariable, 0, "$BAR"},
+			tEOF,
+		}},
+		{"rejected var before escaped dollar", "$FOO$$x", func(v string) bool {
+			return v != "FOO"
+		}, []item{
+			{itemText, 0, "$FOO"},
+			{itemText, 0, "$"},
+			{itemText, 0, "x"},
+			tEOF,
+		}},
+		{"escaped dollar before rejected var", "$$$FOO$BAR", func(v string) bool {
+			return v != "FOO"
+		}, []item{
+			{itemText, 0, "$"},
+			{itemText, 0, "$FOO"},
+			{itemVariable, 0, "$BAR"},
+			tEOF,
+		}},
+		{"rejected var before trailing dollar", "$FOO$", func(v string) bool {
+			return v != "FOO"
+		}, []item{
+			{itemText, 0, "$FOO"},
+			{itemText, 0, "$"},
+			tEOF,
+		}},
+		{"accepted outer, rejected inner substitution", "${X:-${FOO}}", func(v string) bool {
+			return v == "X"
+		}, []item{
+			tLeft,
+			{itemVariable, 0, "X"},
+			tColDash,
+			tLeft,
+			{itemText, 0, "FOO"},
+			tRight,
+			tRight,
+			tEOF,
+		}},
+		{"rejected outer, accepted inner substitution", "${X:-${FOO}}", func(v string) bool {
+			return v == "FOO"
+		}, []item{
+			tLeft,
+			{itemText, 0, "X"},
+			tColDash,
+			tLeft,
+			{itemVariable, 0, "FOO"},
+			tRight,
+			tRight,
+			tEOF,
+		}},
+		{"rejected var in default before accepted var", "${X:-$FOO$BAR}", func(v string) bool {
+			return v != "FOO"
+		}, []item{
+			tLeft,
+			{itemVariable, 0, "X"},
+			tColDash,
+			{itemText, 0, "$FOO"},
+			{itemVariable, 0, "$BAR"},
+			tRight,
+			tEOF,
+		}},
 	}
 
 	for _, tt := range tests {
@@ -400,3 +621,180 @@ func TestLexMatcherEdgeCases(t *testing.T) {
 		})
 	}
 }
+
+// TestLexVarRunePredicates tests custom IsVarStart/IsVarPart predicates
+func TestLexVarRunePredicates(t *testing.T) {
+	noDigits := func(r rune) bool { return r == '_' || unicode.IsLetter(r) }
+	tests := []struct {
+		name, input string
+		want        []item
+	}{
+		{"digit ends variable", "$A1", []item{
+			{itemVariable, 0, "$A"},
+			{itemText, 0, "1"},
+			tEOF,
+		}},
+		{"digit cannot start variable", "$1 $2A", []item{
+			{itemText, 0, "$1 "},
+			{itemText, 0, "$2A"},
+			tEOF,
+		}},
+		{"digit cannot start braced variable", "${1}", []item{
+			tLeft,
+			{itemRightDelim, 0, "1}"},
+			tEOF,
+		}},
+		{"letters and underscore accepted", "${A_B}", []item{
+			tLeft,
+			{itemVariable, 0, "A_B"},
+			tRight,
+			tEOF,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lex(tt.input, &Restrictions{IsVarStart: noDigits, IsVarPart: noDigits})
+			var items []item
+			for {
+				item := l.nextItem()
+				items = append(items, item)
+				if item.typ == itemEOF || item.typ == itemError {
+					break
+				}
+			}
+			if !equal(items, tt.want, false) {
+				t.Errorf("TestLexVarRunePredicates %s:\ninput\n\t%q\ngot\n\t%+v\nexpected\n\t%v", tt.name, tt.input, items, tt.want)
+			}
+		})
+	}
+}
+
+// TestLexAllowUnderscoreVar tests lexing of "_" as a variable name
+func TestLexAllowUnderscoreVar(t *testing.T) {
+	tests := []struct {
+		name, input string
+		allow       bool
+		want        []item
+	}{
+		{"bare rejected by default", "$_", false, []item{{itemText, 0, "$_"}, tEOF}},
+		{"braced rejected by default", "${_}", false, []item{tLeft, {itemText, 0, "_"}, tRight, tEOF}},
+		{"bare allowed", "$_", true, []item{{itemVariable, 0, "$_"}, tEOF}},
+		{"braced allowed", "${_}", true, []item{tLeft, {itemVariable, 0, "_"}, tRight, tEOF}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lex(tt.input, &Restrictions{AllowUnderscoreVar: tt.allow})
+			var items []item
+			for {
+				item := l.nextItem()
+				items = append(items, item)
+				if item.typ == itemEOF || item.typ == itemError {
+					break
+				}
+			}
+			if !equal(items, tt.want, false) {
+				t.Errorf("TestLexAllowUnderscoreVar %s:\ninput\n\t%q\ngot\n\t%+v\nexpected\n\t%v", tt.name, tt.input, items, tt.want)
+			}
+		})
+	}
+}
+
+// TestLexColonInName tests lexing of ':' inside braced names
+func TestLexColonInName(t *testing.T) {
+	tests := []struct {
+		name, input string
+		want        []item
+	}{
+		{"namespaced name", "${db:host}", []item{tLeft, {itemVariable, 0, "db:host"}, tRight, tEOF}},
+		{"several namespaces", "${a:b:c}", []item{tLeft, {itemVariable, 0, "a:b:c"}, tRight, tEOF}},
+		{"operator after name", "${VAR:-x}", []item{tLeft, {itemVariable, 0, "VAR"}, tColDash, {itemText, 0, "x"}, tRight, tEOF}},
+		{"operator after namespaced name", "${db:host:=x}", []item{tLeft, {itemVariable, 0, "db:host"}, tColEquals, {itemText, 0, "x"}, tRight, tEOF}},
+		{"alternate operator", "${db:+x}", []item{tLeft, {itemVariable, 0, "db"}, tColPlus, {itemText, 0, "x"}, tRight, tEOF}},
+		{"bare variable not affected", "$db:host", []item{{itemVariable, 0, "$db"}, {itemText, 0, ":host"}, tEOF}},
+		{"trailing colon", "${db:}", []item{tLeft, {itemVariable, 0, "db"}, {itemError, 0, "bad substitution: operator expected after ':'"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lex(tt.input, &Restrictions{ColonInName: true})
+			var items []item
+			for {
+				item := l.nextItem()
+				items = append(items, item)
+				if item.typ == itemEOF || item.typ == itemError {
+					break
+				}
+			}
+			if !equal(items, tt.want, false) {
+				t.Errorf("TestLexColonInName %s:\ninput\n\t%q\ngot\n\t%+v\nexpected\n\t%v", tt.name, tt.input, items, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexRawDelims(t *testing.T) {
+	tests := []struct {
+		name, input string
+		want        []item
+	}{
+		{"raw region", "a<<<$NOTAVAR ${alsonot}>>>b", []item{{itemText, 0, "a"}, {itemText, 0, "$NOTAVAR ${alsonot}"}, {itemText, 0, "b"}, tEOF}},
+		{"variables around", "$A<<<$B>>>$C", []item{{itemVariable, 0, "$A"}, {itemText, 0, "$B"}, {itemVariable, 0, "$C"}, tEOF}},
+		{"empty region", "<<<>>>", []item{tEOF}},
+		{"escape not special", "<<<$$>>>", []item{{itemText, 0, "$$"}, tEOF}},
+		{"first closing delimiter", "<<<a>>>b>>>", []item{{itemText, 0, "a"}, {itemText, 0, "b>>>"}, tEOF}},
+		{"inside substitution", "${X:-<<<}", []item{tLeft, {itemVariable, 0, "X"}, tColDash, {itemText, 0, "<"}, {itemText, 0, "<"}, {itemText, 0, "<"}, tRight, tEOF}},
+		{"unterminated", "a<<<$B", []item{{itemText, 0, "a"}, {itemError, 0, "unterminated raw region"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lex(tt.input, &Restrictions{RawDelims: [2]string{"<<<", ">>>"}})
+			var items []item
+			for {
+				item := l.nextItem()
+				items = append(items, item)
+				if item.typ == itemEOF || item.typ == itemError {
+					break
+				}
+			}
+			if !equal(items, tt.want, false) {
+				t.Errorf("TestLexRawDelims %s:\ninput\n\t%q\ngot\n\t%+v\nexpected\n\t%v", tt.name, tt.input, items, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexGNUCompat(t *testing.T) {
+	tests := []struct {
+		name, input string
+		want        []item
+	}{
+		{"bare and braced", "a $A ${B}c", []item{{itemText, 0, "a "}, {itemVariable, 0, "$A"}, {itemText, 0, " "}, tLeft, {itemVariable, 0, "B"}, tRight, {itemText, 0, "c"}, tEOF}},
+		{"operator kept", "${A:-x}", []item{{itemText, 0, "${A:-x}"}, tEOF}},
+		{"no escape", "$$A", []item{{itemText, 0, "$"}, {itemVariable, 0, "$A"}, tEOF}},
+		{"digit", "$1 ${1}", []item{{itemText, 0, "$1 ${1}"}, tEOF}},
+		{"underscore", "$_", []item{{itemVariable, 0, "$_"}, tEOF}},
+		{"unclosed brace", "${A", []item{{itemText, 0, "${A"}, tEOF}},
+		{"ascii names", "$Aé", []item{{itemVariable, 0, "$A"}, {itemText, 0, "é"}, tEOF}},
+		{"trailing dollar", "a$", []item{{itemText, 0, "a$"}, tEOF}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lex(tt.input, &Restrictions{GNUCompat: true})
+			var items []item
+			for {
+				item := l.nextItem()
+				items = append(items, item)
+				if item.typ == itemEOF || item.typ == itemError {
+					break
+				}
+			}
+			if !equal(items, tt.want, false) {
+				t.Errorf("TestLexGNUCompat %s:\ninput\n\t%q\ngot\n\t%+v\nexpected\n\t%v", tt.name, tt.input, items, tt.want)
+			}
+		})
+	}
+}
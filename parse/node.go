@@ -2,16 +2,24 @@ package parse
 
 import (
 	"fmt"
+	"path"
 	"strings"
+	"time"
 )
 
 // PatternTransformer defines a function that transforms a variable value according to a specific pattern
 type PatternTransformer func(value string) string
 
+// ContextTransformer defines a function that transforms a variable value knowing
+// the variable name and the Env, e.g. to look up a sibling variable. An error
+// fails the substitution.
+type ContextTransformer func(value string, name string, env *Env) (string, error)
+
 // PatternDefinition combines a transformer function with its syntax suffix
 type PatternDefinition struct {
 	Operator    string             // Bash expansion operator syntax (e.g., "^^", ",,")
 	Transformer PatternTransformer // Function to transform the variable value
+	Context     ContextTransformer // Function to transform the variable value in context, used instead of Transformer if set
 }
 
 // Pattern Transformer System
@@ -22,9 +30,11 @@ type PatternDefinition struct {
 //
 // Architecture:
 // - PatternTransformer: Function type that defines how to transform values
+// - ContextTransformer: Function type for transformers that also need the variable name and Env
 // - PatternDefinition: Struct combining transformer function and operator syntax
 // - patternDefinitions: Maps itemType to PatternDefinition structs
 // - RegisterPatternTransformer: Helper function to register new patterns
+// - RegisterContextTransformer: Helper function to register new context-aware patterns
 //
 // Adding New Patterns:
 // 1. Define a new itemType in lex.go (e.g., itemTitleCase)
@@ -38,14 +48,37 @@ type PatternDefinition struct {
 
 // patternDefinitions maps itemType to their corresponding pattern definitions
 var patternDefinitions = map[itemType]PatternDefinition{
-	itemCaretCaret: {"^^", strings.ToUpper}, // ^^ converts to uppercase
-	itemCommaComma: {",,", strings.ToLower}, // ,, converts to lowercase
+	itemCaretCaret: {Operator: "^^", Transformer: strings.ToUpper}, // ^^ converts to uppercase
+	itemCommaComma: {Operator: ",,", Transformer: strings.ToLower}, // ,, converts to lowercase
 }
 
 // RegisterPatternTransformer allows registering new pattern transformers
 // This makes it easy to extend the system with additional transformation patterns
 func RegisterPatternTransformer(itemType itemType, operator string, transformer PatternTransformer) {
-	patternDefinitions[itemType] = PatternDefinition{operator, transformer}
+	patternDefinitions[itemType] = PatternDefinition{Operator: operator, Transformer: transformer}
+}
+
+// RegisterContextTransformer registers a pattern transformer receiving the
+// variable name and the Env along with the value, it coexists with the value
+// only transformers of RegisterPatternTransformer.
+func RegisterContextTransformer(itemType itemType, operator string, transformer ContextTransformer) {
+	patternDefinitions[itemType] = PatternDefinition{Operator: operator, Context: transformer}
+}
+
+// transform applies the transformer of the definition to the value of the variable v.
+func (d PatternDefinition) transform(v *VariableNode, value string) (string, error) {
+	if d.Context == nil {
+		return d.Transformer(value), nil
+	}
+	out, err := d.Context(value, v.Ident, v.Env)
+	if err != nil {
+		if v.Restrict.secret(v.Ident) {
+			// transformer errors may quote the value
+			return "", Error(fmt.Sprintf("%s: %s failed on %s", v.Ident, d.Operator, redacted), "Transform")
+		}
+		return "", Error(fmt.Sprintf("%s: %v", v.Ident, err), "Transform")
+	}
+	return out, nil
 }
 
 type Node interface {
@@ -66,6 +99,9 @@ const (
 	NodeText NodeType = iota
 	NodeSubstitution
 	NodeVariable
+	NodeChain
+	NodeClock
+	NodeList
 )
 
 type TextNode struct {
@@ -86,40 +122,167 @@ type VariableNode struct {
 	Ident    string // Variable identifier name (e.g., "VAR" from "$VAR" or "${VAR}")
 	Env      *Env
 	Restrict *Restrictions
+	Pos      Pos // Position of the identifier in the input, set by the parser
+
+	// the answer of Restrictions.OnMissing, which is asked at most once
+	asked    bool
+	supplied string
+	found    bool
+
+	// source is the reference as written of a variable in the text of a default
+	// value or of a positional default, which is kept if the variable is not set,
+	// e.g. $5 in ${X:-cost $5} or ${X:-$5}
+	source string
 }
 
 func NewVariable(ident string, env *Env, restrict *Restrictions) *VariableNode {
-	return &VariableNode{NodeVariable, ident, env, restrict}
+	return &VariableNode{NodeType: NodeVariable, Ident: ident, Env: env, Restrict: restrict}
 }
 
 func (t *VariableNode) String() (string, error) {
-	// If KeepUnset is enabled and variable is not set, return source text
-	if t.Restrict.KeepUnset && !t.isSet() {
+	if err := t.Restrict.countSubstitution(); err != nil {
+		return "", err
+	}
+	return t.resolve()
+}
+
+// resolve returns the value of the variable, it is used by the substitution
+// the variable is the subject of.
+func (t *VariableNode) resolve() (string, error) {
+	if t.source != "" && !t.isSet() {
+		if t.Restrict.NormalizeUnset {
+			return string(t.Restrict.sigil()) + "{" + t.Ident + "}", nil
+		}
+		return t.source, nil
+	}
+	// If the variable is not set and kept, return source text
+	if t.kept() {
+		if t.Restrict.NormalizeUnset {
+			return string(t.Restrict.sigil()) + "{" + t.Ident + "}", nil
+		}
 		// Construct the source text format from ident
-		return "$" + t.Ident, nil
+		return string(t.Restrict.sigil()) + t.Ident, nil
 	}
 
 	if err := t.validateNoUnset(); err != nil {
 		return "", err
 	}
-	value := t.Env.Get(t.Ident)
+	if err := t.validateRequired(); err != nil {
+		return "", err
+	}
+	if s, ok := t.placeholder(); ok {
+		return s, nil
+	}
+	value := t.value()
 	if err := t.validateNoEmpty(value); err != nil {
 		return "", err
 	}
 	return value, nil
 }
 
+// name returns the key the variable is looked up with in the Env.
+func (t *VariableNode) name() string {
+	if t.Restrict.NameMapper != nil {
+		return t.Restrict.NameMapper(t.Ident)
+	}
+	return t.Ident
+}
+
+// assign stores value as the value of the variable, in the Env under ParseWithEnv,
+// for the rest of the current Parse otherwise. Outside of a Parse, such as when
+// a template is inspected, nothing is stored.
+func (t *VariableNode) assign(value string) {
+	if t.Restrict.assign {
+		t.Env.Set(t.name(), value)
+		return
+	}
+	if t.Restrict.assigned != nil {
+		t.Restrict.assigned[t.name()] = value
+	}
+}
+
 func (t *VariableNode) isSet() bool {
-	return t.Env.Has(t.Ident)
+	_, ok := t.lookup()
+	return ok
+}
+
+func (t *VariableNode) value() string {
+	v, _ := t.lookup()
+	return t.Restrict.normalizeValue(v)
+}
+
+// lookup returns the raw value of the variable and whether it is set, from the
+// assignments of the current Parse, the Env, the Fallback, the Resolvers and
+// finally OnMissing, the first source having the variable wins.
+func (t *VariableNode) lookup() (string, bool) {
+	name := t.name()
+	if v, ok := t.Restrict.assigned[name]; ok {
+		return v, true
+	}
+	if t.Env.Has(name) {
+		return t.Env.Get(name), true
+	}
+	if t.Restrict.Fallback != nil && t.Restrict.Fallback.Has(name) {
+		return t.Restrict.Fallback.Get(name), true
+	}
+	if v, ok := t.Restrict.resolve(name); ok {
+		return v, true
+	}
+	return t.missing()
+}
+
+// missing returns the value Restrictions.OnMissing supplies for the variable,
+// which is not set in the Env, the Fallback nor the Resolvers.
+func (t *VariableNode) missing() (string, bool) {
+	if t.Restrict.OnMissing == nil {
+		return "", false
+	}
+	if !t.asked {
+		t.supplied, t.found = t.Restrict.OnMissing(t.name())
+		t.asked = true
+	}
+	return t.supplied, t.found
+}
+
+// placeholder returns the UnsetPlaceholder text of an unset variable, if configured.
+func (t *VariableNode) placeholder() (string, bool) {
+	if t.Restrict.UnsetPlaceholder == nil || t.isSet() {
+		return "", false
+	}
+	return t.Restrict.UnsetPlaceholder(t.Ident), true
+}
+
+// notEmpty reports whether the variable is set AND not empty.
+func (t *VariableNode) notEmpty() bool {
+	return t.isSet() && t.value() != ""
+}
+
+// kept reports whether the variable is not set and kept as written, under
+// KeepUnset or a MissingKeep rule.
+func (t *VariableNode) kept() bool {
+	return t.Restrict.missingPolicy(t.Ident) == MissingKeep && !t.isSet()
 }
 
 func (t *VariableNode) validateNoUnset() error {
-	if t.Restrict.NoUnset && !t.isSet() {
+	if t.Restrict.missingPolicy(t.Ident) == MissingError && !t.isSet() {
 		return Error(fmt.Sprintf("variable ${%s} not set", t.Ident), "NoUnset")
 	}
 	return nil
 }
 
+func (t *VariableNode) validateRequired() error {
+	if !t.Restrict.Required {
+		return nil
+	}
+	if !t.isSet() {
+		return Error(fmt.Sprintf("variable ${%s} required but not set", t.Ident), "Required")
+	}
+	if t.value() == "" {
+		return Error(fmt.Sprintf("variable ${%s} required but empty", t.Ident), "Required")
+	}
+	return nil
+}
+
 func (t *VariableNode) validateNoEmpty(value string) error {
 	if t.Restrict.NoEmpty && value == "" && t.isSet() {
 		return Error(fmt.Sprintf("variable ${%s} set but empty", t.Ident), "NoEmpty")
@@ -127,63 +290,337 @@ func (t *VariableNode) validateNoEmpty(value string) error {
 	return nil
 }
 
+// ChainNode is the default of ${A:-$B:-$C:-text} under Restrictions.ChainDefaults,
+// the first alternative that is set and not empty is used, otherwise the last one.
+type ChainNode struct {
+	NodeType
+	Alternatives []Node
+}
+
+// String evaluates the alternatives in order, each at most once, up to the first
+// one rendering a non-empty value.
+func (t *ChainNode) String() (string, error) {
+	last := len(t.Alternatives) - 1
+	for _, alt := range t.Alternatives[:last] {
+		if v, ok := alt.(*VariableNode); ok && !v.notEmpty() {
+			// skipped without evaluation, so that NoUnset does not apply
+			continue
+		}
+		if s, err := alt.String(); err != nil || s != "" {
+			return s, err
+		}
+	}
+	return t.Alternatives[last].String()
+}
+
+// ListNode is a default value made of several pieces, such as the text and the
+// variable of ${A:-x $B}, rendered one after the other.
+type ListNode struct {
+	NodeType
+	Nodes    []Node
+	Restrict *Restrictions
+}
+
+func (t *ListNode) String() (string, error) {
+	// every piece starts in the output where the previous one ended
+	start := t.Restrict.column
+	defer func() { t.Restrict.column = start }()
+	var b strings.Builder
+	for _, n := range t.Nodes {
+		s, err := n.String()
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+		t.Restrict.column = advance(t.Restrict.column, s)
+	}
+	return b.String(), nil
+}
+
+// appendNode returns the default value list with n appended, list is nil for an
+// empty default. Adjacent text is merged.
+func (p *Parser) appendNode(list, n Node) Node {
+	text, isText := n.(*TextNode)
+	switch l := list.(type) {
+	case nil:
+		return n
+	case *TextNode:
+		if isText {
+			l.Text += text.Text
+			return l
+		}
+	case *ListNode:
+		if last, ok := l.Nodes[len(l.Nodes)-1].(*TextNode); ok && isText {
+			last.Text += text.Text
+			return l
+		}
+		l.Nodes = append(l.Nodes, n)
+		return l
+	}
+	return &ListNode{NodeList, []Node{list, n}, p.Restrict}
+}
+
+// ClockNode is a ${|now:layout} substitution under Restrictions.AllowClock, it
+// renders the current time formatted with the Go time layout.
+type ClockNode struct {
+	NodeType
+	Layout   string
+	Restrict *Restrictions
+}
+
+func (t *ClockNode) String() (string, error) {
+	now := time.Now
+	if t.Restrict.Now != nil {
+		now = t.Restrict.Now
+	}
+	return now().Format(t.Layout), nil
+}
+
+// redacted replaces the values of Restrictions.SecretVars.
+const redacted = "***"
+
 type SubstitutionNode struct {
 	NodeType
 	ExpType  itemType
 	Variable *VariableNode
-	Default  Node // Default could be variable or text
+	Default  Node         // Default could be variable or text
+	Else     Node         // Else is the unset value of the ternary operator, if any
+	Filters  []FilterCall // Filters applied to the value, e.g. ${VAR|indent:2}
+	Column   int          // Column of the opening delimiter on its line
+	Source   string       // Source text of the substitution, e.g. "${VAR|indent}"
 }
 
 func (t *SubstitutionNode) String() (string, error) {
+	if err := t.Variable.Restrict.countSubstitution(); err != nil {
+		return "", err
+	}
+	return t.resolve()
+}
+
+// resolve returns the value of the substitution.
+func (t *SubstitutionNode) resolve() (string, error) {
+	if len(t.Filters) > 0 {
+		return t.filter()
+	}
+
 	// Handle pattern transformations using the transformer map
 	if patternDef, hasPatternDef := patternDefinitions[t.ExpType]; hasPatternDef {
-		if t.Variable.Restrict.KeepUnset && !t.Variable.isSet() {
-			// Return original syntax for unset variables when KeepUnset is enabled
-			return "${" + t.Variable.Ident + patternDef.Operator + "}", nil
+		if t.Variable.kept() {
+			// Return original syntax for unset variables that are kept
+			return t.Source, nil
 		}
 
-		value, err := t.Variable.String()
+		value, err := t.Variable.resolve()
+		if _, ok := t.Variable.placeholder(); ok || err != nil {
+			return value, err
+		}
+		transform := func(s string) (string, error) { return patternDef.transform(t.Variable, s) }
+		if t.Default == nil {
+			return transform(value)
+		}
+		// ${VAR^^pattern} only converts the characters matching pattern
+		pattern, err := t.Default.String()
 		if err != nil {
 			return "", err
 		}
-		return patternDef.Transformer(value), nil
+		return transformMatching(t.Variable.Ident, value, pattern, transform)
+	}
+
+	// ? operator: use Default if variable is set AND not empty, Else otherwise
+	if t.ExpType == itemQuestion {
+		branch := t.Else
+		if t.Variable.notEmpty() {
+			branch = t.Default
+		}
+		if branch == nil {
+			return "", nil
+		}
+		return branch.String()
+	}
+
+	// :? operator: fail unless the variable is set and not empty
+	if t.ExpType == itemColonQuestion {
+		if t.Variable.kept() {
+			return t.Source, nil
+		}
+		if !t.Variable.notEmpty() {
+			return "", t.required()
+		}
+		return t.Variable.resolve()
 	}
 
 	// Process default value logic first, regardless of KeepUnset setting
 	if t.ExpType >= itemPlus && t.Default != nil {
-		switch t.ExpType {
-		case itemColonDash, itemColonEquals:
-			// For colon operators, check if variable is set AND not empty
-			if t.Variable.isSet() && t.Variable.Env.Get(t.Variable.Ident) != "" {
-				return t.Variable.String()
-			}
-			return t.Default.String()
-		case itemPlus:
-			// + operator: return alternate if variable is set (regardless of value)
-			if t.Variable.isSet() {
-				return t.Default.String()
+		if t.defaultApplies() {
+			value, err := t.Default.String()
+			if err == nil && t.Variable.Restrict.ExpandDefaultsOnce {
+				value, err = t.expandOnce(value)
 			}
-			return "", nil
-		case itemColonPlus:
-			// :+ operator: return alternate if variable is set AND not empty
-			if t.Variable.isSet() && t.Variable.Env.Get(t.Variable.Ident) != "" {
-				return t.Default.String()
+			if err == nil && (t.ExpType == itemEquals || t.ExpType == itemColonEquals) {
+				// assignment operators also store the default for the rest of the input
+				t.Variable.assign(value)
 			}
+			return value, err
+		}
+		if t.ExpType == itemPlus || t.ExpType == itemColonPlus {
+			// the alternate value of an unset or empty variable is empty
 			return "", nil
-		default:
-			// For non-colon operators (dash, equals), check if variable is set
-			if !t.Variable.isSet() {
-				return t.Default.String()
-			}
 		}
+		return t.Variable.resolve()
 	}
 
-	// If KeepUnset is enabled and variable is not set, return source text
+	// If the variable is not set and kept, return source text
 	// (only if no defaults were processed above)
-	if t.Variable.Restrict.KeepUnset && !t.Variable.isSet() {
+	if t.Variable.kept() {
 		// Construct the source text format from ident
-		return "${" + t.Variable.Ident + "}", nil
+		return string(t.Variable.Restrict.sigil()) + "{" + t.Variable.Ident + "}", nil
 	}
 
-	return t.Variable.String()
+	return t.Variable.resolve()
+}
+
+// required returns the error of a :? substitution whose variable is unset or
+// empty. The word following the operator is the message, and also the error code
+// if it is an identifier such as E_MISSING_DB, the code is "Required" otherwise.
+func (t *SubstitutionNode) required() error {
+	message, code := "parameter null or not set", "Required"
+	if t.Default != nil {
+		word, err := t.Default.String()
+		if err != nil {
+			return err
+		}
+		if word != "" {
+			message = word
+		}
+		if isIdentifier(word) {
+			code = word
+		}
+	}
+	return Error(fmt.Sprintf("%s: %s", t.Variable.Ident, message), code)
+}
+
+// isIdentifier reports whether s is made of ASCII letters, digits and
+// underscores and does not start with a digit.
+func isIdentifier(s string) bool {
+	if s == "" || !isGNUNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isGNUNamePart(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandOnce expands the variables in the value of a used default under
+// Restrictions.ExpandDefaultsOnce, the result is not expanded again.
+func (t *SubstitutionNode) expandOnce(value string) (string, error) {
+	r := *t.Variable.Restrict
+	r.ExpandDefaultsOnce = false
+	p := &Parser{Name: "default", Env: t.Variable.Env, Restrict: &r}
+	if err := p.build(value); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, node := range p.nodes {
+		s, err := node.String()
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(s)
+		r.column = advance(r.column, s)
+	}
+	return b.String(), nil
+}
+
+// transformMatching applies transform to each character of value that matches
+// the glob pattern, as in ${VAR^^[aeiou]}. An empty pattern matches every character.
+func transformMatching(ident, value, pattern string, transform func(string) (string, error)) (string, error) {
+	if pattern == "" {
+		return transform(value)
+	}
+	var b strings.Builder
+	for _, r := range value {
+		matched, err := path.Match(pattern, string(r))
+		if err != nil {
+			return "", Error(fmt.Sprintf("%s: bad pattern %q", ident, pattern), "Pattern")
+		}
+		if matched {
+			s, err := transform(string(r))
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// defaultApplies reports whether the Default of a default or alternate value
+// operator is used instead of the variable.
+func (t *SubstitutionNode) defaultApplies() bool {
+	switch t.ExpType {
+	case itemColonDash, itemColonEquals:
+		// For colon operators, check if variable is set AND not empty
+		return !t.Variable.notEmpty()
+	case itemPlus:
+		// + operator: use alternate if variable is set (regardless of value)
+		return t.Variable.isSet()
+	case itemColonPlus:
+		// :+ operator: use alternate if variable is set AND not empty
+		return t.Variable.notEmpty()
+	default:
+		// For non-colon operators (dash, equals), check if variable is set
+		return !t.Variable.isSet()
+	}
+}
+
+// coalesces reports whether the filter pipeline has an or filter.
+func (t *SubstitutionNode) coalesces() bool {
+	for _, f := range t.Filters {
+		if f.Name == "or" {
+			return true
+		}
+	}
+	return false
+}
+
+// filter applies the filter pipeline to the value of the variable.
+func (t *SubstitutionNode) filter() (string, error) {
+	var value string
+	var err error
+	if t.coalesces() {
+		// an unset or empty subject is the point of the or filter, which supplies
+		// the value, so NoUnset, NoEmpty and Required do not apply to it
+		value = t.Variable.value()
+	} else {
+		if t.Variable.kept() {
+			return t.Source, nil
+		}
+		value, err = t.Variable.resolve()
+		if _, ok := t.Variable.placeholder(); ok || err != nil {
+			return value, err
+		}
+	}
+	ctx := &FilterContext{Name: t.Variable.Ident, Column: t.Variable.Restrict.column, Env: t.Variable.Env, Set: t.Variable.isSet()}
+	ctx.Lookup = func(name string) (string, bool) {
+		v := NewVariable(name, t.Variable.Env, t.Variable.Restrict)
+		if !v.isSet() {
+			return "", false
+		}
+		return v.value(), true
+	}
+	for _, f := range t.Filters {
+		if value, err = filterDefinitions[f.Name](ctx, value, f.Args); err != nil {
+			if t.Variable.Restrict.secret(t.Variable.Ident) {
+				// filter errors may quote the value
+				return "", Error(fmt.Sprintf("%s: %s failed on %s", t.Variable.Ident, f.Name, redacted), "Filter")
+			}
+			return "", Error(fmt.Sprintf("%s: %v", t.Variable.Ident, err), "Filter")
+		}
+	}
+	return value, nil
 }
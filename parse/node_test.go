@@ -1,7 +1,9 @@
 package parse
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -128,6 +130,54 @@ func TestPatternDefinitionStructCohesion(t *testing.T) {
 	}
 }
 
+// TestContextTransformer verifies transformers receiving the variable name and Env
+func TestContextTransformer(t *testing.T) {
+	original := patternDefinitions[itemCaretCaret]
+	defer func() { patternDefinitions[itemCaretCaret] = original }()
+
+	// ${VAR^^} prefixes the value with the value of VAR_PREFIX
+	RegisterContextTransformer(itemCaretCaret, "^^", func(value, name string, env *Env) (string, error) {
+		if !env.Has(name + "_PREFIX") {
+			return "", fmt.Errorf("no prefix for %q", value)
+		}
+		return env.Get(name+"_PREFIX") + value, nil
+	})
+	env := NewEnv([]string{"HOST=example.com", "HOST_PREFIX=www.", "PORT=80", "TOKEN=s3cret"})
+
+	testCases := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		err                   string
+	}{
+		{"name and env", "${HOST^^}", "www.example.com", &Restrictions{}, ""},
+		{"matching characters", "${HOST^^[x]}", "ewww.xample.com", &Restrictions{}, ""},
+		{"error", "${PORT^^}", "", &Restrictions{}, `PORT: no prefix for "80"`},
+		{"secret error", "${TOKEN^^}", "", &Restrictions{SecretVars: map[string]bool{"TOKEN": true}}, "TOKEN: ^^ failed on ***"},
+		{"keep unset", "${NOTSET^^}", "${NOTSET^^}", &Restrictions{KeepUnset: true}, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, tc.restrict).Parse(tc.input)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err || !errors.Is(err, Error("", "Transform")) {
+					t.Fatalf("expected Transform error %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+
+	// value only transformers keep working next to context-aware ones
+	if result, _ := New("test", env, &Restrictions{}).Parse("${HOST,,}"); result != "example.com" {
+		t.Errorf("expected ,, to be unchanged, got %q", result)
+	}
+}
+
 // TestPatternDefinitionCompleteness verifies all pattern definitions are complete
 func TestPatternDefinitionCompleteness(t *testing.T) {
 	for itemType, patternDef := range patternDefinitions {
@@ -151,3 +201,383 @@ func TestPatternDefinitionCompleteness(t *testing.T) {
 		})
 	}
 }
+
+// TestNameMapper verifies that variable names are mapped before lookup
+func TestNameMapper(t *testing.T) {
+	env := NewEnv([]string{"MYAPP_HOST=example.com", "MYAPP_EMPTY=", "HOST=unprefixed"})
+	prefix := func(name string) string { return "MYAPP_" + name }
+
+	testCases := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+	}{
+		{"identity by default", "${HOST}", "unprefixed", &Restrictions{}, false},
+		{"bare variable mapped", "$HOST", "example.com", &Restrictions{NameMapper: prefix}, false},
+		{"braced variable mapped", "${HOST}", "example.com", &Restrictions{NameMapper: prefix}, false},
+		{"default value variable mapped", "${NOTSET:-$HOST}", "example.com", &Restrictions{NameMapper: prefix}, false},
+		{"default text variable mapped", "${NOTSET:-http://$HOST/}", "http://example.com/", &Restrictions{NameMapper: prefix}, false},
+		{"pattern mapped", "${HOST^^}", "EXAMPLE.COM", &Restrictions{NameMapper: prefix}, false},
+		{"NoUnset checks mapped name", "${HOST}", "example.com", &Restrictions{NameMapper: prefix, NoUnset: true}, false},
+		{"NoUnset fails on unmapped name", "${PORT}", "", &Restrictions{NameMapper: prefix, NoUnset: true}, true},
+		{"NoEmpty checks mapped name", "${EMPTY}", "", &Restrictions{NameMapper: prefix, NoEmpty: true}, true},
+		{"KeepUnset keeps original name", "${PORT}", "${PORT}", &Restrictions{NameMapper: prefix, KeepUnset: true}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, tc.restrict).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestUnsetPlaceholder verifies that unset variables without defaults render as the placeholder
+func TestUnsetPlaceholder(t *testing.T) {
+	env := NewEnv([]string{"SET=value", "EMPTY="})
+	missing := func(name string) string { return "<MISSING:" + name + ">" }
+
+	testCases := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+	}{
+		{"bare variable", "$DB_HOST", "<MISSING:DB_HOST>", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"braced variable", "host=${DB_HOST}", "host=<MISSING:DB_HOST>", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"set variable", "$SET", "value", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"empty variable is set", "[$EMPTY]", "[]", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"default applies", "${DB_HOST:-localhost}", "localhost", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"unset default variable", "${DB_HOST:-$DB_FALLBACK}", "<MISSING:DB_FALLBACK>", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"pattern not transformed", "${DB_HOST^^}", "<MISSING:DB_HOST>", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"filter not applied", "${DB_HOST|urlencode}", "<MISSING:DB_HOST>", &Restrictions{UnsetPlaceholder: missing}, false},
+		{"KeepUnset takes precedence", "${DB_HOST}", "${DB_HOST}", &Restrictions{UnsetPlaceholder: missing, KeepUnset: true}, false},
+		{"NoUnset takes precedence", "${DB_HOST}", "", &Restrictions{UnsetPlaceholder: missing, NoUnset: true}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := New("test", env, tc.restrict).Parse(tc.input)
+			if hasErr := err != nil; hasErr != tc.hasErr {
+				t.Fatalf("expected error=%v, got %v", tc.hasErr, err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+// TestFallbackEnv verifies that variables missing from the Env are resolved from Restrictions.Fallback
+func TestFallbackEnv(t *testing.T) {
+	primary := NewEnv([]string{"HOST=primary", "EMPTY="})
+	fallback := NewEnv([]string{"HOST=secondary", "PORT=80", "EMPTY=secondary", "USER=admin"})
+
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+	}{
+		{"primary wins", "$HOST", "primary", &Restrictions{Fallback: fallback}, false},
+		{"fallback supplies value", "${PORT}", "80", &Restrictions{Fallback: fallback}, false},
+		{"empty primary is set", "[$EMPTY]", "[]", &Restrictions{Fallback: fallback}, false},
+		{"fallback before default", "${PORT:-8080}", "80", &Restrictions{Fallback: fallback}, false},
+		{"default when missing from both", "${NOPE:-x}", "x", &Restrictions{Fallback: fallback}, false},
+		{"fallback suppresses NoUnset", "$USER:$PORT", "admin:80", &Restrictions{Fallback: fallback, NoUnset: true}, false},
+		{"NoUnset when missing from both", "$NOPE", "", &Restrictions{Fallback: fallback, NoUnset: true}, true},
+		{"fallback with pattern", "${USER^^}", "ADMIN", &Restrictions{Fallback: fallback}, false},
+		{"KeepUnset with fallback", "$USER $NOPE", "admin $NOPE", &Restrictions{Fallback: fallback, KeepUnset: true}, false},
+		{"no fallback", "[$PORT]", "[]", &Restrictions{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, primary, test.restrict).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("expected error=%v, got %v", test.hasErr, err)
+			}
+			if result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+}
+
+// mapResolver is a Resolver backed by a map, counting its lookups.
+type mapResolver struct {
+	vars    map[string]string
+	lookups int
+}
+
+func (m *mapResolver) Has(key string) bool {
+	m.lookups++
+	_, ok := m.vars[key]
+	return ok
+}
+
+func (m *mapResolver) Get(key string) string {
+	return m.vars[key]
+}
+
+// TestResolvers verifies that Restrictions.Resolvers are consulted in order for the variables missing from the Env
+func TestResolvers(t *testing.T) {
+	env := NewEnv([]string{"HOST=primary"})
+	first := NewEnv([]string{"REGION=eu"})
+	second := &mapResolver{vars: map[string]string{"HOST": "second", "PORT": "80", "REGION": "us", "EMPTY": ""}}
+	third := NewEnv([]string{"PORT=8080", "USER=admin", "EMPTY=third"})
+	resolvers := []Resolver{first, second, third}
+
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+	}{
+		{"env wins", "$HOST", "primary", &Restrictions{Resolvers: resolvers}, false},
+		{"second resolver", "$PORT", "80", &Restrictions{Resolvers: resolvers}, false},
+		{"first resolver wins", "$REGION", "eu", &Restrictions{Resolvers: resolvers}, false},
+		{"last resolver", "$USER", "admin", &Restrictions{Resolvers: resolvers}, false},
+		{"empty in a resolver is set", "[${EMPTY-default}]", "[]", &Restrictions{Resolvers: resolvers}, false},
+		{"empty in a resolver with colon default", "${EMPTY:-default}", "default", &Restrictions{Resolvers: resolvers}, false},
+		{"resolver before default", "${PORT:-8080}", "80", &Restrictions{Resolvers: resolvers}, false},
+		{"resolver with alternate value", "${PORT:+set}", "set", &Restrictions{Resolvers: resolvers}, false},
+		{"default when missing from all", "${NOPE:-x}", "x", &Restrictions{Resolvers: resolvers}, false},
+		{"resolvers suppress NoUnset", "$USER:$PORT", "admin:80", &Restrictions{Resolvers: resolvers, NoUnset: true}, false},
+		{"NoUnset when missing from all", "$NOPE", "", &Restrictions{Resolvers: resolvers, NoUnset: true}, true},
+		{"KeepUnset when missing from all", "$PORT $NOPE", "80 $NOPE", &Restrictions{Resolvers: resolvers, KeepUnset: true}, false},
+		{"fallback before resolvers", "$PORT", "443", &Restrictions{Fallback: NewEnv([]string{"PORT=443"}), Resolvers: resolvers}, false},
+		{"resolvers before OnMissing", "$PORT $NOPE", "80 asked", &Restrictions{Resolvers: resolvers, OnMissing: func(string) (string, bool) { return "asked", true }}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, env, test.restrict).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("expected error=%v, got %v", test.hasErr, err)
+			}
+			if result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+
+	second.lookups = 0
+	if _, err := New("order", env, &Restrictions{Resolvers: resolvers}).Parse("$HOST $REGION"); err != nil {
+		t.Fatal(err)
+	}
+	if second.lookups != 0 {
+		t.Errorf("expected the second resolver not to be consulted, got %d lookups", second.lookups)
+	}
+}
+
+// TestResolversCached verifies that a Resolver is asked once per variable and Parse
+func TestResolversCached(t *testing.T) {
+	slow := &mapResolver{vars: map[string]string{"SLOW": "value"}}
+	parser := New("cached", NewEnv(nil), &Restrictions{Resolvers: []Resolver{slow}})
+
+	result, err := parser.Parse("${SLOW} $SLOW ${SLOW:-x}")
+	if err != nil || result != "value value value" {
+		t.Fatalf("expected %q, got %q, %v", "value value value", result, err)
+	}
+	if slow.lookups != 1 {
+		t.Errorf("expected 1 lookup for three references, got %d", slow.lookups)
+	}
+
+	slow.lookups = 0
+	if result, err = parser.Parse("[$NOPE][${NOPE}][${NOPE-x}]"); err != nil || result != "[][][x]" {
+		t.Fatalf("expected %q, got %q, %v", "[][][x]", result, err)
+	}
+	if slow.lookups != 1 {
+		t.Errorf("expected 1 lookup of a missing variable, got %d", slow.lookups)
+	}
+
+	// every Parse asks again
+	slow.lookups = 0
+	slow.vars["SLOW"] = "changed"
+	if result, err = parser.Parse("$SLOW $SLOW"); err != nil || result != "changed changed" {
+		t.Fatalf("expected %q, got %q, %v", "changed changed", result, err)
+	}
+	if slow.lookups != 1 {
+		t.Errorf("expected 1 lookup in a new Parse, got %d", slow.lookups)
+	}
+}
+
+// TestOnMissing verifies values supplied for missing variables by Restrictions.OnMissing
+func TestOnMissing(t *testing.T) {
+	env := NewEnv([]string{"HOST=localhost", "EMPTY="})
+	var asked []string
+	onMissing := func(name string) (string, bool) {
+		asked = append(asked, name)
+		if name == "PORT" || name == "USER" {
+			return strings.ToLower(name) + "-value", true
+		}
+		return "", false
+	}
+
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+		asked                 []string
+	}{
+		{"supplied", "$HOST:$PORT", "localhost:port-value", &Restrictions{}, false, []string{"PORT"}},
+		{"declined", "[$NOPE]", "[]", &Restrictions{}, false, []string{"NOPE"}},
+		{"set empty not asked", "[$EMPTY]", "[]", &Restrictions{}, false, nil},
+		{"supplied before NoUnset", "${USER}", "user-value", &Restrictions{NoUnset: true}, false, []string{"USER"}},
+		{"declined with NoUnset", "$NOPE", "", &Restrictions{NoUnset: true}, true, []string{"NOPE"}},
+		{"supplied before default", "${PORT:-8080}", "port-value", &Restrictions{}, false, []string{"PORT"}},
+		{"declined uses default", "${NOPE:-x}", "x", &Restrictions{}, false, []string{"NOPE"}},
+		{"declined with KeepUnset", "$PORT $NOPE", "port-value $NOPE", &Restrictions{KeepUnset: true}, false, []string{"PORT", "NOPE"}},
+		{"asked once per reference", "${PORT^^} $PORT", "PORT-VALUE port-value", &Restrictions{}, false, []string{"PORT", "PORT"}},
+		{"mapped name", "$RT", "port-value", &Restrictions{NameMapper: func(n string) string { return "PO" + n }}, false, []string{"PORT"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			asked = nil
+			test.restrict.OnMissing = onMissing
+			result, err := New(test.name, env, test.restrict).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("expected error=%v, got %v", test.hasErr, err)
+			}
+			if result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+			if !reflect.DeepEqual(asked, test.asked) {
+				t.Errorf("expected %q to be asked, got %q", test.asked, asked)
+			}
+		})
+	}
+	if env.Has("PORT") {
+		t.Error("a supplied value must not be stored in the Env")
+	}
+}
+
+// TestMissingRules verifies the per-prefix handling of unset variables by Restrictions.MissingRules
+func TestMissingRules(t *testing.T) {
+	env := NewEnv([]string{"SECRET_SET=s", "OPT_SET=o", "SECRET_EMPTY="})
+	secrets := []MissingRule{{"SECRET_", MissingError}}
+
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		errMsg                string
+	}{
+		{"missing secret", "$OPT_Y ${SECRET_X}", "", &Restrictions{MissingRules: secrets}, "variable ${SECRET_X} not set"},
+		{"missing optional", "[$OPT_Y] $SECRET_SET", "[] s", &Restrictions{MissingRules: secrets}, ""},
+		{"set secret", "$SECRET_SET $OPT_SET", "s o", &Restrictions{MissingRules: secrets}, ""},
+		{"empty secret", "[$SECRET_EMPTY]", "[]", &Restrictions{MissingRules: secrets}, ""},
+		{"default applies", "${SECRET_X:-x}", "x", &Restrictions{MissingRules: secrets}, ""},
+		{"filtered", "${SECRET_X|pad:2}", "", &Restrictions{MissingRules: secrets}, "variable ${SECRET_X} not set"},
+		{"empty rule over NoUnset", "[$OPT_Y]", "[]", &Restrictions{NoUnset: true, MissingRules: []MissingRule{{"OPT_", MissingEmpty}}}, ""},
+		{"NoUnset without match", "$OTHER", "", &Restrictions{NoUnset: true, MissingRules: []MissingRule{{"OPT_", MissingEmpty}}}, "variable ${OTHER} not set"},
+		{"keep rule", "$TPL_A ${TPL_B} ${TPL_C^^} [$OPT_Y]", "$TPL_A ${TPL_B} ${TPL_C^^} []", &Restrictions{MissingRules: []MissingRule{{"TPL_", MissingKeep}}}, ""},
+		{"error rule over KeepUnset", "$OPT_Y $SECRET_X", "", &Restrictions{KeepUnset: true, MissingRules: secrets}, "variable ${SECRET_X} not set"},
+		{"KeepUnset without match", "$OPT_Y", "$OPT_Y", &Restrictions{KeepUnset: true, MissingRules: secrets}, ""},
+		{"first rule wins", "[$SECRET_OPT_X]", "[]", &Restrictions{MissingRules: []MissingRule{{"SECRET_OPT_", MissingEmpty}, {"SECRET_", MissingError}}}, ""},
+		{"empty prefix matches all", "$OPT_Y", "", &Restrictions{MissingRules: []MissingRule{{"", MissingError}}}, "variable ${OPT_Y} not set"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, env, test.restrict).Parse(test.input)
+			if test.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.errMsg != "" && (err == nil || err.Error() != test.errMsg) {
+				t.Fatalf("expected error %q, got %v", test.errMsg, err)
+			}
+			if result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+
+	// ParseCollect substitutes the variables of error rules as empty
+	p := New("collect", env, &Restrictions{MissingRules: secrets})
+	out, missing, err := p.ParseCollect("[$SECRET_X]")
+	if err != nil || out != "[]" || !reflect.DeepEqual(missing, []string{"SECRET_X"}) {
+		t.Errorf("ParseCollect: got %q, %q, %v", out, missing, err)
+	}
+}
+
+// TestColonQuestion verifies the ${VAR:?word} operator and the error codes it declares
+func TestColonQuestion(t *testing.T) {
+	env := NewEnv([]string{"DB=db", "EMPTY=", "NAME=E_FROM_VAR"})
+
+	tests := []struct {
+		name, input, expected, errMsg, code string
+	}{
+		{"set", "${DB:?E_MISSING_DB}", "db", "", ""},
+		{"unset with code", "${NOTSET:?E_MISSING_DB}", "", "NOTSET: E_MISSING_DB", "E_MISSING_DB"},
+		{"empty with code", "${EMPTY:?E_MISSING_DB}", "", "EMPTY: E_MISSING_DB", "E_MISSING_DB"},
+		{"message", "${NOTSET:?set the database}", "", "NOTSET: set the database", "Required"},
+		{"no word", "${NOTSET:?}", "", "NOTSET: parameter null or not set", "Required"},
+		{"not an identifier", "${NOTSET:?1_CODE}", "", "NOTSET: 1_CODE", "Required"},
+		{"expanded word", "${NOTSET:?$NAME}", "", "NOTSET: E_FROM_VAR", "E_FROM_VAR"},
+		{"text around", "host=${DB:?E_DB}:5432", "host=db:5432", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, env, &Restrictions{}).Parse(test.input)
+			if test.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.errMsg != "" && (err == nil || err.Error() != test.errMsg) {
+				t.Fatalf("expected error %q, got %v", test.errMsg, err)
+			}
+			if test.code != "" && !errors.Is(err, Error("", test.code)) {
+				t.Errorf("expected error code %q, got %v", test.code, err)
+			}
+			if result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+
+	// the declared code is distinct from the others
+	_, err := New("code", env, &Restrictions{}).Parse("${NOTSET:?E_MISSING_DB}")
+	if errors.Is(err, Error("", "E_OTHER")) || errors.Is(err, Error("", "NoUnset")) {
+		t.Errorf("expected only the code E_MISSING_DB, got %v", err)
+	}
+	// kept as written for a later phase under KeepUnset
+	if result, err := New("keep", env, &Restrictions{KeepUnset: true}).Parse("${NOTSET:?E_MISSING_DB}"); err != nil || result != "${NOTSET:?E_MISSING_DB}" {
+		t.Errorf("expected the substitution to be kept, got %q, %v", result, err)
+	}
+}
+
+// TestNormalizeForm verifies the Unicode normalization of substituted values
+func TestNormalizeForm(t *testing.T) {
+	decomposed, composed := "Cafe\u0301", "Caf\u00e9"
+	env := NewEnv([]string{"NFD=" + decomposed, "NFC=" + composed})
+
+	tests := []struct {
+		name, input, expected string
+		form                  UnicodeForm
+	}{
+		{"none keeps decomposed", "$NFD", decomposed, FormNone},
+		{"none keeps composed", "$NFC", composed, FormNone},
+		{"NFC composes", "$NFD", composed, FormNFC},
+		{"NFC keeps composed", "${NFC}", composed, FormNFC},
+		{"NFD decomposes", "${NFC}", decomposed, FormNFD},
+		{"NFC before transform", "${NFD^^}", "CAF\u00c9", FormNFC},
+		{"NFC in default text", "${NOTSET:-x $NFD}", "x " + composed, FormNFC},
+		{"template text untouched", "Cafe\u0301 $NFD", "Cafe\u0301 " + composed, FormNFC},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, env, &Restrictions{NormalizeForm: test.form}).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result)
+			}
+		})
+	}
+}
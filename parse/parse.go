@@ -3,7 +3,14 @@ package parse
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 // A mode value is a set of flags (or 0). They control parser behavior.
@@ -12,12 +19,55 @@ type Mode int
 // Mode for parser behaviour
 const (
 	Quick     Mode = iota // stop parsing after first error encoutered and return
-	AllErrors             // report all errors
+	AllErrors             // report all errors, an unterminated ${ is taken as text to go on
+)
+
+// NewlinePolicy controls the trailing newline of the rendered output.
+type NewlinePolicy int
+
+// Trailing newline policies
+const (
+	NewlineKeep   NewlinePolicy = iota // keep trailing newlines as rendered
+	NewlineEnsure                      // add a newline if the output does not end with one
+	NewlineStrip                       // strip trailing newlines down to a single one
+)
+
+// MissingPolicy is how a variable that is not set is substituted when no
+// default applies.
+type MissingPolicy int
+
+// Missing variable policies
+const (
+	MissingEmpty MissingPolicy = iota // substitute an empty string
+	MissingError                      // fail with the NoUnset error
+	MissingKeep                       // keep the reference as written, like KeepUnset
+)
+
+// MissingRule applies Policy to the variables whose name starts with Prefix.
+type MissingRule struct {
+	Prefix string
+	Policy MissingPolicy
+}
+
+// UnicodeForm selects the Unicode normalization of substituted values.
+type UnicodeForm int
+
+// Unicode normalization forms
+const (
+	FormNone UnicodeForm = iota // leave values unchanged
+	FormNFC                     // canonical composition, e.g. "é" as a single rune
+	FormNFD                     // canonical decomposition, e.g. "é" as 'e' and a combining accent
 )
 
 // Restrictions controls the parsing and substitution behavior of environment variables.
 // These options determine how the parser handles undefined variables, empty variables,
 // numeric variables, and variable matching patterns.
+//
+// Values are safe: the value of a variable is substituted as it is and never scanned
+// for references again, whatever the options, so with BAR="${EVIL}" the input $BAR
+// renders as ${EVIL}. The only exceptions are opt-in, ExpandDefaultsOnce expands
+// the value of a used default one more time and AllowTemplateTransform lets ${VAR@tpl}
+// execute a value as a template.
 type Restrictions struct {
 	// NoUnset when true causes the parser to return an error if a variable is not set.
 	// When false (default), unset variables are substituted with empty strings.
@@ -29,6 +79,13 @@ type Restrictions struct {
 	// Example: If VAR="" then ${VAR} will cause an error if NoEmpty is true.
 	NoEmpty bool
 
+	// Required when true causes the parser to return an error if a variable is not
+	// set or set but empty, both reported with the single error code "Required".
+	// A default that applies satisfies the requirement. NoUnset and NoEmpty remain
+	// available to tell the two cases apart.
+	// Example: ${DB_HOST} and ${DB_HOST-x} fail if DB_HOST="", ${DB_HOST:-x} does not.
+	Required bool
+
 	// NoDigit when true causes the parser to ignore variables that start with a digit.
 	// When false (default), numeric variables are processed normally.
 	// Example: $1 and ${1} will be treated as literal text if NoDigit is true.
@@ -36,17 +93,286 @@ type Restrictions struct {
 
 	// KeepUnset when true causes undefined variables to be kept as their original text
 	// instead of being substituted with empty strings or causing errors.
-	// When true, this option automatically disables NoUnset and NoEmpty restrictions.
+	// When true, this option automatically disables NoUnset, NoEmpty and Required restrictions.
 	// Example: ${UNDEFINED_VAR} will remain as "${UNDEFINED_VAR}" in the output.
 	KeepUnset bool
 
+	// MissingRules optionally choose how a variable that is not set is substituted
+	// depending on its name, the first rule whose Prefix starts the name applies.
+	// The variables matching no rule follow KeepUnset and NoUnset.
+	// Example: []MissingRule{{"SECRET_", MissingError}} fails on an unset ${SECRET_X}
+	// and substitutes an unset ${OPT_Y} with an empty string.
+	MissingRules []MissingRule
+
+	// NormalizeUnset when true keeps undefined variables like KeepUnset, which it
+	// implies, but writes bare references in braces, so that a template rendered
+	// in several phases only contains ${VAR} references.
+	// Example: "$HOST:${PORT}" renders as "${HOST}:${PORT}" if neither is set.
+	NormalizeUnset bool
+
 	// VarMatcher is an optional predicate function to filter valid variable tokens.
 	// If provided, only variables that pass this filter will be processed.
 	// Variables that don't match will be treated as literal text.
+	// The matcher decides for every reference on its own, wherever it appears: a
+	// rejected substitution is kept as written, with the accepted variables in it
+	// expanded, both at the top level and nested in a default value.
+	// Example: accepting only BAR, ${X:-${Y:-$BAR}} renders as "${X:-${Y:-bar}}"
+	// and, accepting X and BAR, as "${Y:-bar}" if X is unset.
 	VarMatcher varMatcher
+
+	// AllowUnderscoreVar when true makes $_ and ${_} regular variables.
+	// When false (default), "_" is never treated as a variable name and is kept as text.
+	AllowUnderscoreVar bool
+
+	// LongestMatch when true makes a bare $VAR that is not set resolve to the longest
+	// set variable whose name is a prefix of VAR, the rest is kept as text.
+	// When false (default), bare variable names are matched greedily: $HOSTNAME always
+	// refers to HOSTNAME, never to HOST. Use braces, ${HOST}NAME, to disambiguate.
+	// Example: with only HOST=h set, $HOSTNAME renders as "hNAME" if LongestMatch is true.
+	LongestMatch bool
+
+	// UnsetPlaceholder optionally returns the text substituted for an unset variable
+	// when no default applies, it is called with the variable name. KeepUnset,
+	// NoUnset and Required take precedence over it.
+	// Example: func(n string) string { return "<MISSING:" + n + ">" } renders ${DB} as "<MISSING:DB>".
+	UnsetPlaceholder func(name string) string
+
+	// NameMapper optionally maps the variable name used in the template to the key
+	// looked up in the Env, restriction checks apply to the mapped key.
+	// When nil (default), names are looked up as written.
+	// Example: func(n string) string { return "MYAPP_" + n } makes ${HOST} read MYAPP_HOST.
+	NameMapper func(name string) string
+
+	// Fallback is an optional secondary Env consulted for the variables missing
+	// from the parser's Env, before defaults and restrictions apply.
+	// A variable set in Fallback counts as set, for instance for NoUnset.
+	// Example: with Fallback holding PORT=80, ${PORT:-8080} renders as "80" if PORT is not in Env.
+	Fallback *Env
+
+	// Resolvers are optional further sources consulted in order, after the Env and
+	// the Fallback, for the variables missing from both. The first resolver having
+	// the variable provides its value, and the variable counts as set. The answer
+	// is reused by the other references of the variable in the same Parse.
+	// Example: []Resolver{secrets, NewEnvOverlay(nil)} reads a secret store first,
+	// then the process environment.
+	Resolvers []Resolver
+
+	// OnMissing is optionally called for a variable that is set neither in the Env
+	// nor in the Fallback or the Resolvers, at the moment its value is needed. If it
+	// returns ok the value is used and the variable counts as set, so NoUnset and
+	// defaults do not apply, otherwise the variable is handled as unset. It is called at most once
+	// per reference of the variable and the Env is not modified.
+	// Example: prompt for the value of ${DB_PASSWORD} instead of failing.
+	OnMissing func(name string) (value string, ok bool)
+
+	// TrailingNewline controls the trailing newline of the rendered output, it is
+	// applied after all substitutions so values at the end of the input count too.
+	// When NewlineKeep (default), the output is left unchanged.
+	// Example: "a\n\n\n" renders as "a\n" with NewlineStrip, "a" as "a\n" with NewlineEnsure.
+	TrailingNewline NewlinePolicy
+
+	// NormalizeForm selects the Unicode normalization applied to the values of
+	// variables before they are substituted or transformed.
+	// When FormNone (default), values are used as they are.
+	// Example: with FormNFC a value "e\u0301" from a macOS file name renders as "\u00e9".
+	NormalizeForm UnicodeForm
+
+	// Sigil is the rune introducing variables and substitutions, doubling it escapes it.
+	// When zero (default), '$' is used.
+	// Example: with '@', @VAR and @{VAR:-x} are substituted and @@VAR renders as "@VAR".
+	Sigil rune
+
+	// IsVarStart optionally reports whether a rune may start a variable name,
+	// both after a bare '$' and after '${'.
+	// When nil (default), letters, digits and underscore are accepted.
+	IsVarStart func(r rune) bool
+
+	// IsVarPart optionally reports whether a rune may continue a variable name.
+	// When nil (default), letters, digits and underscore are accepted.
+	// Example: a predicate rejecting digits makes $A1 expand $A followed by "1".
+	IsVarPart func(r rune) bool
+
+	// DoubleBraceEscape when true makes "}}" in the value part of a substitution a
+	// literal '}' instead of the closing delimiter. Doubling only applies to the
+	// outermost substitution: inside a nested ${...} a '}' always closes it.
+	// Example: ${VAR:-a}}b} renders as "a}b" if VAR is unset.
+	DoubleBraceEscape bool
+
+	// GNUCompat when true makes the parser behave like GNU envsubst: only $VAR and
+	// ${VAR} are substituted, where VAR is made of ASCII letters, digits and
+	// underscores and does not start with a digit. Any other use of '$' is kept
+	// as written, so neither "$$" escapes nor operators are recognized, and the
+	// options of the syntax, such as Sigil, IsVarStart or RawDelims, are ignored.
+	// VarMatcher still applies, like the SHELL-FORMAT argument of GNU envsubst.
+	// Example: "${HOME:-x} $$HOME $1" renders as "${HOME:-x} $/root $1" for HOME=/root.
+	GNUCompat bool
+
+	// RawDelims optionally holds the opening and closing delimiters of inline raw
+	// regions, whose content is written verbatim: neither variables nor escapes
+	// are recognized in it and the delimiters themselves are removed. A region
+	// ends at the first closing delimiter, an unterminated one is an error. Raw
+	// regions are recognized outside of substitutions only. NewReader processes
+	// its input line by line, so a raw region must not span lines there.
+	// When empty (default), there are no raw regions.
+	// Example: with {"<<<", ">>>"}, "jq '<<<.[] | $x>>>' $F" renders as "jq '.[] | $x' " followed by the value of F.
+	RawDelims [2]string
+
+	// StrictEmptyBrace when true reports a substitution without a variable name,
+	// such as ${} or ${:-x}, as a syntax error.
+	// When false (default), it is kept as literal text.
+	StrictEmptyBrace bool
+
+	// MaxNameLength limits the length of variable names, in runes, to harden against
+	// pathological input. A longer name is treated as text like a name rejected by
+	// the VarMatcher, or is a syntax error under StrictNameLength.
+	// When zero (default), names are unlimited.
+	// Example: with 8, $USER_ID is substituted and ${USER_NAME} is kept as is.
+	MaxNameLength int
+
+	// StrictNameLength when true reports a variable name longer than MaxNameLength
+	// as a syntax error.
+	// When false (default), it is kept as literal text.
+	StrictNameLength bool
+
+	// StrictSubst when true reports text following the variable name in braces
+	// that does not start an operator as a syntax error.
+	// When false (default), the text is ignored, unless KeepMalformed keeps the
+	// substitution as written.
+	// Example: ${VAR junk} and ${VAR :-x} are errors if StrictSubst is true,
+	// ${VAR:-junk} is not.
+	StrictSubst bool
+
+	// KeepMalformed when true keeps a substitution that fails to parse, such as one
+	// with an unknown operator or filter, as literal text and parses on after it.
+	// Text following the variable without an operator, as in ${A%x}, is kept too.
+	// A substitution without closing brace on its line only keeps its opening
+	// delimiter. Errors with a code, such as those of NoDefaults, are still reported.
+	// When false (default), such a substitution is a syntax error.
+	// Example: with KeepMalformed, "${A|nofilter} $B" renders "${A|nofilter}" as is
+	// followed by the value of B, and so does "${A $B".
+	KeepMalformed bool
+
+	// NoDollarEscape when true disables the "$$" escape, so that each '$' is
+	// handled on its own: a '$' that does not start a variable is literal text.
+	// When false (default), "$$" renders as a single '$'.
+	// Example: $$BAR renders as "$" followed by the value of BAR if NoDollarEscape
+	// is true, as "$BAR" otherwise.
+	NoDollarEscape bool
+
+	// ColonInName when true makes a ':' after the name in braces part of the name
+	// when it is followed by a character allowed in names, so that ${db:host} looks
+	// up the key "db:host". A ':' followed by '-', '=' or '+' still starts the
+	// :-, := and :+ operators.
+	// Example: ${db:host:-localhost} uses db:host, or "localhost" if it is not set.
+	ColonInName bool
+
+	// MaxErrors limits the number of errors collected in AllErrors mode, rendering
+	// stops once it is reached. It has no effect in Quick mode.
+	// When zero (default), all errors are reported.
+	MaxErrors int
+
+	// ChainDefaults when true makes a ':-' following a variable or a nested
+	// substitution in the default of the :- operator start another alternative,
+	// the first alternative that is set and not empty is used.
+	// When false (default), the rest of the default is literal text.
+	// Example: ${A:-$B:-${C}:-none} renders A, else B, else C, else "none".
+	ChainDefaults bool
+
+	// SecretVars holds the names of variables whose values must not be revealed,
+	// they are replaced by "***" in errors and explanations that could echo them.
+	// Example: map[string]bool{"DB_PASSWORD": true}
+	SecretVars map[string]bool
+
+	// ExpandDefaultsOnce when true expands the variables in the value of a default
+	// or alternate value that is used one more time, so that a default referring to
+	// a variable whose value itself contains references renders them too. The
+	// second pass does not expand again, so there is no recursion.
+	// When false (default), the value of a default is used as it is.
+	// Example: with B="$C" and C="c", ${A:-$B} renders as "c" if A is unset.
+	ExpandDefaultsOnce bool
+
+	// NoDefaults when true causes the parser to return an error for every use of the
+	// default and alternate value operators :-, -, :=, =, :+ and +, so that each
+	// variable must be provided explicitly.
+	// Example: ${PORT:-8080} is an error if NoDefaults is true, ${PORT} is not.
+	NoDefaults bool
+
+	// MaxSubstitutions limits the number of variables and substitutions evaluated
+	// by a single Parse, nested ones included, exceeding it is an error.
+	// When zero (default), there is no limit.
+	// Example: with 2, "$A $B" renders but "$A ${B:-$C}" fails.
+	MaxSubstitutions int
+
+	// AllowTemplateTransform when true enables the tpl filter, ${VAR@tpl}, which
+	// executes the value of VAR as a Go text/template with the variables of the Env
+	// as data. As values may then run template actions, it is disabled by default.
+	// Example: with URL="http://{{.HOST}}", ${URL@tpl} renders the value of HOST in it.
+	AllowTemplateTransform bool
+
+	// AllowClock when true enables ${|now:layout}, which renders the current time
+	// formatted with the Go time layout, RFC 3339 if none is given. As the output
+	// then changes from one run to the next, it is disabled by default.
+	// Example: ${BUILD_DATE:-${|now:2006-01-02}} renders the date if BUILD_DATE is unset.
+	AllowClock bool
+
+	// Now optionally replaces time.Now as the clock of ${|now}, e.g. for tests.
+	Now func() time.Time
+
+	// Preprocess optionally transforms the whole input before it is lexed, e.g. to
+	// normalize line endings. Positions and columns, such as in errors, refer to
+	// the preprocessed text.
+	// Example: func(s string) string { return strings.ReplaceAll(s, "\r\n", "\n") }
+	Preprocess func(text string) string
+
+	// Postprocess optionally transforms the rendered output, after TrailingNewline
+	// is applied. An error aborts rendering and is returned from Parse.
+	// Example: reject output that still contains "TODO".
+	Postprocess func(output string) (string, error)
+
+	// OutputFilters optionally transform the rendered output one after the other,
+	// after Postprocess, each receiving the output of the previous one. An error
+	// aborts rendering and is returned from Parse.
+	// Example: []func([]byte) ([]byte, error){format.Source} formats rendered Go code.
+	OutputFilters []func(output []byte) ([]byte, error)
+
+	// OnDeprecated is optionally called for every use of an operator registered
+	// with DeprecateOperator, with the operator as reported by OperatorsUsed and
+	// its position in the input. Parsing continues normally.
+	OnDeprecated func(op string, pos Pos)
+
+	// WarnSuspicious is optionally called with a warning and its position in the
+	// input for a substitution that looks like a mistyped operator: white space
+	// before an operator, or a ':' without one. The output is not changed.
+	// Example: ${VAR :-x} warns, as it renders VAR and ignores " :-x".
+	WarnSuspicious func(warning string, pos Pos)
+
+	// substitutions counts the evaluations of the current Parse under MaxSubstitutions.
+	substitutions *int
+
+	// assign makes the := and = operators store the default they use in the Env,
+	// it is set by ParseAssign.
+	assign bool
+
+	// assigned holds the defaults stored by the := and = operators during the
+	// current Parse when they are not stored in the Env.
+	assigned map[string]string
+
+	// resolved caches the answers of the Resolvers during the current Parse,
+	// including the variables none of them has.
+	resolved map[string]resolution
+
+	// recover makes the lexer go on after an error, it is set by build in
+	// AllErrors mode.
+	recover bool
+
+	// column is the column of the output, in runes, at which the node being
+	// rendered starts, so that filters see where they land in the output.
+	column int
 }
 
 // Parser type initializer
+// A Parser holds the state of the current parse and must not be used by several
+// goroutines at once, create one parser per goroutine instead.
 type Parser struct {
 	Name     string // name of the processing template
 	Env      *Env
@@ -57,49 +383,285 @@ type Parser struct {
 	token     [3]item // three-token lookahead
 	peekCount int
 	nodes     []Node
+	partial   bool // render the nodes before a syntax error, set by ParsePartial
+	// reuse makes build reuse the nodes and their storage from the previous
+	// parse, set by ParseAppend.
+	reuse  bool
+	texts  []TextNode
+	vars   []VariableNode
+	substs []SubstitutionNode
+	// inspect is optionally called by render with every top level node before it
+	// is evaluated, the function it returns, if any, with the outcome. It sees the
+	// state of the parse at that point, such as the assignments before the node.
+	inspect func(n Node) func(value string, err error)
 }
 
 // New allocates a new Parser with the given name.
+// The restrictions are copied and normalized, r itself is never modified.
 func New(name string, env *Env, r *Restrictions) *Parser {
-	if r != nil && r.KeepUnset {
-		r.NoEmpty = false
-		r.NoUnset = false
-	}
 	return &Parser{
 		Name:     name,
 		Env:      env,
-		Restrict: r,
+		Restrict: r.normalize(),
+	}
+}
+
+// Restrictions returns the effective restrictions of the parser.
+func (p *Parser) Restrictions() Restrictions {
+	return *p.Restrict.normalize()
+}
+
+// sigil returns the rune introducing variables.
+func (r *Restrictions) sigil() rune {
+	if r == nil || r.Sigil == 0 || r.GNUCompat {
+		return '$'
+	}
+	return r.Sigil
+}
+
+// raw reports whether text may contain a raw region under RawDelims.
+func (r *Restrictions) raw(text string) bool {
+	return r.RawDelims[0] != "" && r.RawDelims[1] != "" && strings.Contains(text, r.RawDelims[0])
+}
+
+// secret reports whether the value of the variable name must be redacted.
+func (r *Restrictions) secret(name string) bool {
+	return r != nil && r.SecretVars[name]
+}
+
+// countSubstitution counts an evaluated variable or substitution against
+// MaxSubstitutions and returns an error once the limit is exceeded.
+func (r *Restrictions) countSubstitution() error {
+	if r.MaxSubstitutions <= 0 || r.substitutions == nil {
+		return nil
+	}
+	*r.substitutions++
+	if *r.substitutions > r.MaxSubstitutions {
+		return Error(fmt.Sprintf("too many substitutions, the limit is %d", r.MaxSubstitutions), "MaxSubstitutions")
+	}
+	return nil
+}
+
+// normalizeValue applies the NormalizeForm to the value of a variable.
+func (r *Restrictions) normalizeValue(value string) string {
+	switch r.NormalizeForm {
+	case FormNFC:
+		return norm.NFC.String(value)
+	case FormNFD:
+		return norm.NFD.String(value)
 	}
+	return value
+}
+
+// resolution is the answer of the Resolvers for a variable.
+type resolution struct {
+	value string
+	ok    bool
+}
+
+// resolve looks name up in the Resolvers, the first one having it wins. The
+// answer is cached for the rest of the current Parse, so a slow Resolver is
+// asked at most once per variable.
+func (r *Restrictions) resolve(name string) (string, bool) {
+	if res, ok := r.resolved[name]; ok {
+		return res.value, res.ok
+	}
+	var res resolution
+	for _, resolver := range r.Resolvers {
+		if resolver.Has(name) {
+			res = resolution{resolver.Get(name), true}
+			break
+		}
+	}
+	if r.resolved != nil {
+		r.resolved[name] = res
+	}
+	return res.value, res.ok
+}
+
+// missingPolicy returns the policy for the variable name when it is not set.
+func (r *Restrictions) missingPolicy(name string) MissingPolicy {
+	for _, rule := range r.MissingRules {
+		if strings.HasPrefix(name, rule.Prefix) {
+			return rule.Policy
+		}
+	}
+	switch {
+	case r.KeepUnset:
+		return MissingKeep
+	case r.NoUnset:
+		return MissingError
+	}
+	return MissingEmpty
+}
+
+// normalize returns a copy of r with conflicting options resolved.
+// NormalizeUnset implies KeepUnset, which disables the NoUnset, NoEmpty and
+// Required restrictions.
+func (r *Restrictions) normalize() *Restrictions {
+	c := &Restrictions{}
+	if r != nil {
+		*c = *r
+	}
+	if c.NormalizeUnset {
+		c.KeepUnset = true
+	}
+	if c.KeepUnset {
+		c.NoEmpty = false
+		c.NoUnset = false
+		c.Required = false
+	}
+	return c
 }
 
 // Parse parses the given string.
 func (p *Parser) Parse(text string) (string, error) {
-	p.lex = lex(text, p.Restrict.NoDigit, p.Restrict.VarMatcher)
+	if p.Restrict.Preprocess != nil {
+		text = p.Restrict.Preprocess(text)
+	}
+	if p.plain(text) {
+		// fast path: nothing to substitute, skip the lexer entirely
+		p.nodes = p.nodes[:0]
+		return p.output(text)
+	}
+	var out strings.Builder
+	if err := p.render(&out, text); err != nil {
+		return "", err
+	}
+	return p.output(out.String())
+}
+
+// ParsePartial is like Parse but on error also returns the output rendered up to
+// the error, to locate where rendering went wrong in a large template. After a
+// syntax error, the substitutions before it are rendered. The output options of
+// the restrictions only apply to a complete output.
+func (p *Parser) ParsePartial(text string) (string, error) {
+	p.partial = true
+	defer func() { p.partial = false }()
+	if p.Restrict.Preprocess != nil {
+		text = p.Restrict.Preprocess(text)
+	}
+	if p.plain(text) {
+		p.nodes = p.nodes[:0]
+		return p.output(text)
+	}
+	var out strings.Builder
+	if err := p.render(&out, text); err != nil {
+		return out.String(), err
+	}
+	return p.output(out.String())
+}
+
+// ParseAppend is like Parse but appends the output to dst and returns the
+// extended slice, so that a buffer can be reused across renders instead of
+// allocating the output of each. The parser likewise reuses the storage of its
+// nodes from one ParseAppend to the next. On error dst is returned as it was.
+// The output options of the restrictions, such as Postprocess, need the whole
+// output as a string, with them the output is appended after the fact.
+func (p *Parser) ParseAppend(dst []byte, text string) ([]byte, error) {
+	p.reuse = true
+	defer func() { p.reuse = false }()
+	if p.Restrict.TrailingNewline != NewlineKeep || p.Restrict.Postprocess != nil || len(p.Restrict.OutputFilters) > 0 {
+		s, err := p.Parse(text)
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, s...), nil
+	}
+	if p.Restrict.Preprocess != nil {
+		text = p.Restrict.Preprocess(text)
+	}
+	if p.plain(text) {
+		p.nodes = p.nodes[:0]
+		return append(dst, text...), nil
+	}
+	out := appender(dst)
+	if err := p.render(&out, text); err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// appender is a byte slice growing with WriteString, for ParseAppend.
+type appender []byte
+
+func (a *appender) WriteString(s string) (int, error) {
+	*a = append(*a, s...)
+	return len(s), nil
+}
+
+// plain reports whether text has nothing to substitute.
+func (p *Parser) plain(text string) bool {
+	return !strings.ContainsRune(text, p.Restrict.sigil()) && !p.Restrict.raw(text)
+}
+
+// render parses text and writes the evaluated nodes to out, before the output
+// options of the restrictions apply.
+func (p *Parser) render(out io.StringWriter, text string) error {
+	// fresh assignments for every parse, kept by the nodes of this parse only
+	// and dropped with the rest of its state when it returns
+	restrict := p.Restrict
+	r := *restrict
+	r.assigned = make(map[string]string)
+	p.Restrict = &r
+	defer func() { r.assigned, p.Restrict = nil, restrict }()
+	if p.Restrict.MaxSubstitutions > 0 {
+		// a fresh count too
+		r.substitutions = new(int)
+		defer func() { r.substitutions = nil }()
+	}
+	if len(p.Restrict.Resolvers) > 0 {
+		// and a fresh cache of the resolvers
+		r.resolved = make(map[string]resolution)
+		defer func() { r.resolved = nil }()
+	}
 	// Build internal array of all unset or empty vars here
 	var errs []error
-	// clean parse state
-	p.nodes = make([]Node, 0)
-	p.peekCount = 0
-	if err := p.parse(); err != nil {
-		switch p.Mode {
-		case Quick:
-			return "", err
-		case AllErrors:
-			errs = append(errs, err)
+	syntaxErr := p.build(text)
+	if syntaxErr != nil {
+		switch {
+		case p.Mode == AllErrors:
+			// each recovered syntax error counts against MaxErrors
+			if joined, ok := syntaxErr.(interface{ Unwrap() []error }); ok {
+				errs = append(errs, joined.Unwrap()...)
+			} else {
+				errs = append(errs, syntaxErr)
+			}
+			if max := p.Restrict.MaxErrors; max > 0 && len(errs) > max {
+				errs = errs[:max]
+			}
+		case !p.partial:
+			return syntaxErr
 		}
 	}
-	var out string
+	col := 0 // column of the output, in runes, on its last line
 	for _, node := range p.nodes {
+		if max := p.Restrict.MaxErrors; max > 0 && len(errs) >= max {
+			break
+		}
+		r.column = col
+		var done func(value string, err error)
+		if p.inspect != nil {
+			done = p.inspect(node)
+		}
 		s, err := node.String()
+		if done != nil {
+			done(s, err)
+		}
 		if err != nil {
 			switch p.Mode {
 			case Quick:
-				return "", err
+				return err
 			case AllErrors:
 				errs = append(errs, err)
 			}
 		}
-		out += s
+		out.WriteString(s)
+		col = advance(col, s)
+	}
+	if syntaxErr != nil && p.Mode == Quick {
+		// rendered partially up to the syntax error
+		return syntaxErr
 	}
 	if len(errs) > 0 {
 		var b strings.Builder
@@ -109,111 +671,649 @@ func (p *Parser) Parse(text string) (string, error) {
 			}
 			b.WriteString(err.Error())
 		}
-		return "", errors.New(b.String())
+		return errors.New(b.String())
 	}
-	return out, nil
+	return nil
+}
+
+// build parses text into the nodes of the parser without evaluating them.
+func (p *Parser) build(text string) error {
+	if p.Mode == AllErrors {
+		// recover from malformed substitutions to report the errors after them
+		r := *p.Restrict
+		r.recover = true
+		p.lex = lex(text, &r)
+	} else {
+		p.lex = lex(text, p.Restrict)
+	}
+	// clean parse state
+	if p.reuse {
+		clear(p.nodes)
+		p.nodes, p.texts, p.vars, p.substs = p.nodes[:0], p.texts[:0], p.vars[:0], p.substs[:0]
+	} else {
+		p.nodes, p.texts, p.vars, p.substs = make([]Node, 0), nil, nil, nil
+	}
+	p.peekCount = 0
+	err := p.parse()
+	// the parser may stop before EOF, release the lexer goroutine.
+	p.lex.drain()
+	return err
+}
+
+// output applies the output options of the restrictions to the rendered text.
+func (p *Parser) output(s string) (string, error) {
+	s = trailingNewline(s, p.Restrict.TrailingNewline)
+	if p.Restrict.Postprocess != nil {
+		var err error
+		if s, err = p.Restrict.Postprocess(s); err != nil {
+			return "", err
+		}
+	}
+	if len(p.Restrict.OutputFilters) == 0 {
+		return s, nil
+	}
+	b := []byte(s)
+	for _, filter := range p.Restrict.OutputFilters {
+		var err error
+		if b, err = filter(b); err != nil {
+			return "", err
+		}
+	}
+	return string(b), nil
+}
+
+// trailingNewline applies the newline policy to the rendered output.
+func trailingNewline(s string, policy NewlinePolicy) string {
+	switch policy {
+	case NewlineEnsure:
+		if !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+	case NewlineStrip:
+		if trimmed := strings.TrimRight(s, "\n"); len(trimmed) < len(s) {
+			s = trimmed + "\n"
+		}
+	}
+	return s
+}
+
+// ParseTimeout parses the given string like Parse, but returns an error if
+// parsing takes longer than d. The work runs on a copy of the parser in its own
+// goroutine, so p remains usable after a timeout.
+func (p *Parser) ParseTimeout(text string, d time.Duration) (string, error) {
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	q := *p
+	go func() {
+		out, err := q.Parse(text)
+		done <- result{out, err}
+	}()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-timer.C:
+		return "", Error(fmt.Sprintf("parsing %s timed out after %v", p.Name, d), "Timeout")
+	}
+}
+
+// ParseWithEnv parses the given string against a copy of the parser's Env and returns
+// the copy along with the output. The := and = operators store the defaults they use
+// in the copy, so that it can be carried forward to a later step; p.Env is left untouched.
+func (p *Parser) ParseWithEnv(text string) (string, *Env, error) {
+	q := *p
+	q.Env = p.Env.Clone()
+	out, err := q.ParseAssign(text)
+	if err != nil {
+		return "", nil, err
+	}
+	return out, q.Env, nil
+}
+
+// ParseAssign is like ParseWithEnv but stores the assignments of the := and =
+// operators in the Env of the parser itself, which is modified, so that the next
+// parses see them, e.g. when a document is parsed piece by piece.
+func (p *Parser) ParseAssign(text string) (string, error) {
+	r := *p.Restrict
+	r.assign = true
+	q := *p
+	q.Restrict = &r
+	return q.Parse(text)
 }
 
 // parse is the top-level parser for the template.
 // It runs to EOF and return an error if something isn't right.
 func (p *Parser) parse() error {
+	// errors collected in AllErrors mode
+	var errs []error
+	fail := func(err error) error {
+		if p.Mode != AllErrors {
+			return err
+		}
+		errs = append(errs, err)
+		return nil
+	}
 Loop:
 	for {
 		switch t := p.next(); t.typ {
 		case itemEOF:
 			break Loop
 		case itemError:
-			return p.errorf(t.val)
+			if err := fail(p.errorf(t.val)); err != nil {
+				return err
+			}
 		case itemVariable:
-			varNode := NewVariable(strings.TrimPrefix(t.val, "$"), p.Env, p.Restrict)
-			p.nodes = append(p.nodes, varNode)
+			p.variable(t)
 		case itemLeftDelim:
 			if p.peek().typ == itemVariable {
-				n, err := p.action()
+				n, err := p.action(t.pos)
 				if err != nil {
-					return err
+					var coded *interErr
+					if p.Restrict.KeepMalformed && !errors.As(err, &coded) {
+						p.malformed(t.pos)
+						continue
+					}
+					if err = fail(err); err != nil {
+						return err
+					}
+					continue
+				}
+				p.nodes = append(p.nodes, n)
+				continue
+			}
+			if p.peek().typ == itemPipe && p.Restrict.AllowClock {
+				n, err := p.clock()
+				if err != nil {
+					if err = fail(err); err != nil {
+						return err
+					}
+					continue
 				}
 				p.nodes = append(p.nodes, n)
 				continue
 			}
+			if err := p.emptyBrace(); err != nil {
+				if err = fail(err); err != nil {
+					return err
+				}
+			}
 			fallthrough
 		default:
-			textNode := NewText(t.val)
+			textNode := p.newText(t.val)
 			p.nodes = append(p.nodes, textNode)
 		}
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// malformed adds the source of the substitution starting at pos, which failed to
+// parse, as text under KeepMalformed and resumes lexing after it. The source ends
+// at the matching closing brace, a substitution left open on its line only keeps
+// its opening delimiter.
+func (p *Parser) malformed(pos Pos) {
+	input, left := p.lex.input, p.lex.leftDelim()
+	end := pos + Pos(len(left))
+	for i, depth := end, 1; int(i) < len(input) && input[i] != '\n'; i++ {
+		if strings.HasPrefix(input[i:], left) {
+			depth++
+			i += Pos(len(left) - 1)
+		} else if input[i] == '}' {
+			if depth--; depth == 0 {
+				end = i + 1
+				break
+			}
+		}
+	}
+	p.nodes = append(p.nodes, p.newText(input[pos:end]))
+	p.lex.drain()
+	p.lex = p.lex.restart(end)
+	p.peekCount = 0
+}
+
+// ident returns the variable name of a variable token, without the sigil.
+func (p *Parser) ident(val string) string {
+	return strings.TrimPrefix(val, string(p.Restrict.sigil()))
+}
+
+// newVariable returns the node of the variable token t.
+func (p *Parser) newVariable(t item) *VariableNode {
+	ident := p.ident(t.val)
+	n := p.storedVariable(NewVariable(ident, p.Env, p.Restrict))
+	n.Pos = t.pos + Pos(len(t.val)-len(ident))
+	return n
+}
+
+// newSubstitution returns a pointer to n, from the storage reused by ParseAppend if set.
+func (p *Parser) newSubstitution(n SubstitutionNode) *SubstitutionNode {
+	if p.reuse {
+		return alloc(&p.substs, n)
+	}
+	return &n
+}
+
+// storedVariable returns v, moved to the storage reused by ParseAppend if set.
+func (p *Parser) storedVariable(v *VariableNode) *VariableNode {
+	if p.reuse {
+		return alloc(&p.vars, *v)
+	}
+	return v
+}
+
+// newText returns a text node, from the storage reused by ParseAppend if set.
+func (p *Parser) newText(text string) *TextNode {
+	if p.reuse {
+		return alloc(&p.texts, TextNode{NodeText, text})
+	}
+	return NewText(text)
+}
+
+// alloc stores v in the storage *s and returns a pointer to it. A full storage
+// is replaced by a larger one, so that the pointers returned so far stay valid.
+func alloc[T any](s *[]T, v T) *T {
+	if len(*s) == cap(*s) {
+		*s = make([]T, 0, max(2*cap(*s), 16))
+	}
+	*s = append(*s, v)
+	return &(*s)[len(*s)-1]
+}
+
+// variable adds the node(s) of a bare variable reference.
+func (p *Parser) variable(t item) {
+	varNode := p.newVariable(t)
+	if p.Restrict.LongestMatch && !varNode.isSet() {
+		ident := varNode.Ident
+		for i := len(ident) - 1; i > 0; i-- {
+			if !utf8.RuneStart(ident[i]) {
+				continue
+			}
+			if prefix := NewVariable(ident[:i], p.Env, p.Restrict); prefix.isSet() {
+				prefix = p.storedVariable(prefix)
+				prefix.Pos = varNode.Pos
+				p.nodes = append(p.nodes, prefix, p.newText(ident[i:]))
+				return
+			}
+		}
+	}
+	p.nodes = append(p.nodes, varNode)
 }
 
 // Parse substitution. first item is a variable.
-func (p *Parser) action() (Node, error) {
+// pos is the position of the opening delimiter.
+func (p *Parser) action(pos Pos) (Node, error) {
 	var expType itemType
-	var defaultNode Node
+	var defaultNode, thenNode Node
+	var hasElse bool
+	var filters []FilterCall
+	var chain []Node
+	var end Pos
+	var stray Pos // start of text following the variable without an operator
 
 	varToken := p.next()
-	varNode := NewVariable(varToken.val, p.Env, p.Restrict)
+	varNode := p.newVariable(varToken)
 
 Loop:
 	for {
 		switch t := p.next(); t.typ {
 		case itemRightDelim:
+			end = t.pos + Pos(len(t.val))
 			break Loop
 		case itemError:
 			return nil, p.errorf(t.val)
 		case itemVariable:
-			defaultNode = NewVariable(strings.TrimPrefix(t.val, "$"), p.Env, p.Restrict)
+			v := p.newVariable(t)
+			// only a whole alternative is chained, as $B in ${A:-$B:-c}
+			if defaultNode == nil && p.chainSeparator(expType) {
+				chain = append(chain, v)
+				continue
+			}
+			if first, _ := utf8.DecodeRuneInString(v.Ident); defaultNode != nil || unicode.IsDigit(first) {
+				// in the text of the default, or a positional $5, kept as written if unset
+				v.source = t.val
+			}
+			defaultNode = p.appendNode(defaultNode, v)
 		case itemText:
-			n := NewText(t.val)
-		Text:
-			for {
-				switch p.peek().typ {
-				case itemRightDelim, itemError, itemEOF:
-					break Text
-				case itemVariable:
-					// Handle variable expansion in default values
-					nextToken := p.next()
-					varName := strings.TrimPrefix(nextToken.val, "$")
-					if p.Env.Has(varName) {
-						varValue := p.Env.Get(varName)
-						n.Text += varValue
-					} else {
-						// Variable not set, keep original text
-						n.Text += nextToken.val
-					}
-				case itemLeftDelim:
-					// For nested substitutions, break out of text processing
-					// and let the main parser loop handle the itemLeftDelim
-					break Text
-				default:
-					// patch to accept all kind of chars
-					nextToken := p.next()
-					n.Text += nextToken.val
-				}
+			if expType == 0 && stray == 0 {
+				stray = t.pos
 			}
-			defaultNode = n
+			if expType == itemQuestion && !hasElse && t.val == ":" {
+				// the first ':' of a ternary separates the set and unset values
+				hasElse = true
+				thenNode, defaultNode = defaultNode, nil
+				continue
+			}
+			n := p.newText(p.defaultText(t, expType == itemQuestion && !hasElse))
+			defaultNode = p.appendNode(defaultNode, n)
 		case itemLeftDelim:
 			// Handle nested substitution like ${VAR} within default values
 			if p.peek().typ == itemVariable {
-				nestedSubst, err := p.action()
+				nestedSubst, err := p.action(t.pos)
 				if err != nil {
 					return nil, err
 				}
-				// Evaluate the nested substitution and use its result as the default
-				nestedResult, err := nestedSubst.String()
+				// The nested substitution is evaluated when the default is used
+				if defaultNode == nil && p.chainSeparator(expType) {
+					chain = append(chain, nestedSubst)
+					continue
+				}
+				defaultNode = p.appendNode(defaultNode, nestedSubst)
+			} else if p.peek().typ == itemPipe && p.Restrict.AllowClock {
+				clock, err := p.clock()
 				if err != nil {
 					return nil, err
 				}
-				defaultNode = NewText(nestedResult)
+				if defaultNode == nil && p.chainSeparator(expType) {
+					chain = append(chain, clock)
+					continue
+				}
+				defaultNode = p.appendNode(defaultNode, clock)
 			} else {
-				// Not a valid variable substitution, treat as text
-				defaultNode = NewText("${")
+				if err := p.emptyBrace(); err != nil {
+					return nil, err
+				}
+				// Not a valid variable substitution, such as one rejected by the
+				// VarMatcher, treat it as text like at the top level
+				rejected, err := p.rejectedSubstitution(t)
+				if err != nil {
+					return nil, err
+				}
+				defaultNode = p.appendNode(defaultNode, rejected)
+			}
+		case itemPipe, itemAt:
+			spec, closing, err := p.filterSpec()
+			if err != nil {
+				return nil, err
+			}
+			if t.typ == itemAt && strings.Contains(spec, "|") {
+				return nil, p.errorf("bad substitution: invalid operator @" + spec)
 			}
+			if filters, err = parseFilters(spec); err != nil {
+				return nil, p.errorf(err.Error())
+			}
+			for _, f := range filters {
+				if f.Name == "tpl" && !p.Restrict.AllowTemplateTransform {
+					return nil, p.errorf("bad substitution: the tpl filter is not allowed")
+				}
+				p.deprecated(t.val+f.Name, t.pos)
+			}
+			end = closing
+			break Loop
+		case itemSlash, itemSlashSlash:
+			spec, closing, err := p.filterSpec()
+			if err != nil {
+				return nil, err
+			}
+			p.deprecated(t.val, t.pos)
+			name := "replace"
+			if t.typ == itemSlashSlash {
+				name = "replaceall"
+			}
+			pattern, replacement := splitPattern(spec)
+			filters = []FilterCall{{name, []string{pattern, replacement}}}
+			end = closing
+			break Loop
 		default:
+			p.deprecated(t.val, t.pos)
 			expType = t.typ
 		}
 	}
 
-	return &SubstitutionNode{NodeSubstitution, expType, varNode, defaultNode}, nil
+	if stray > 0 {
+		p.suspicious(p.lex.input[stray:end], stray, p.lex.input[pos:end])
+		if p.Restrict.StrictSubst || p.Restrict.KeepMalformed {
+			// an unknown operator such as '%' is kept as written under KeepMalformed
+			return nil, p.errorf("bad substitution: unexpected text after the variable in " + p.lex.input[pos:end])
+		}
+	}
+	if p.Restrict.NoDefaults && isDefaultOperator(expType) {
+		return nil, Error(fmt.Sprintf("default value not allowed in %s", p.lex.input[pos:end]), "NoDefaults")
+	}
+	if defaultNode == nil && isDefaultOperator(expType) {
+		// an explicit empty default, such as ${VAR:-}, still counts as a default
+		defaultNode = p.newText("")
+	}
+	if len(chain) > 0 {
+		defaultNode = &ChainNode{NodeChain, append(chain, defaultNode)}
+	}
+	n := p.newSubstitution(SubstitutionNode{
+		NodeType: NodeSubstitution,
+		ExpType:  expType,
+		Variable: varNode,
+		Default:  defaultNode,
+		Filters:  filters,
+		Column:   p.column(pos),
+		Source:   p.lex.input[pos:end],
+	})
+	if hasElse {
+		n.Default, n.Else = thenNode, defaultNode
+	}
+	return n, nil
+}
+
+// defaultText returns the text t of a default value followed by the text after
+// it, up to a variable, a nested substitution or the end of the substitution.
+// If then is true, it also stops at the ':' ending the set value of a ternary.
+func (p *Parser) defaultText(t item, then bool) string {
+	text, input := t.val, p.lex.input
+	// the lexer emits the text rune by rune, it is sliced from the input rather
+	// than concatenated as long as the pieces are as written
+	sliced := strings.HasPrefix(input[t.pos:], text)
+	for {
+		if then && p.peek().val == ":" {
+			return text
+		}
+		switch p.peek().typ {
+		case itemRightDelim, itemError, itemEOF, itemVariable, itemLeftDelim:
+			// variables and nested substitutions are nodes of their own,
+			// evaluated when the default is used
+			return text
+		default:
+			// patch to accept all kind of chars
+			nextToken := p.next()
+			end := int(t.pos) + len(text)
+			if sliced && int(nextToken.pos) == end && strings.HasPrefix(input[end:], nextToken.val) {
+				text = input[t.pos : end+len(nextToken.val)]
+			} else {
+				text, sliced = text+nextToken.val, false
+			}
+		}
+	}
+}
+
+// rejectedSubstitution returns a nested substitution without a variable name,
+// opened by the delimiter open, as text up to its closing delimiter. Variables
+// and substitutions in it are still expanded, as they are in a rejected
+// substitution at the top level.
+func (p *Parser) rejectedSubstitution(open item) (Node, error) {
+	var n Node = p.newText(open.val)
+	for depth := 1; depth > 0; {
+		switch t := p.next(); t.typ {
+		case itemError, itemEOF:
+			p.backup()
+			return n, nil
+		case itemVariable:
+			v := p.newVariable(t)
+			v.source = t.val
+			n = p.appendNode(n, v)
+		case itemLeftDelim:
+			if p.peek().typ == itemVariable {
+				nested, err := p.action(t.pos)
+				if err != nil {
+					return nil, err
+				}
+				n = p.appendNode(n, nested)
+				continue
+			}
+			depth++
+			n = p.appendNode(n, p.newText(t.val))
+		case itemRightDelim:
+			depth--
+			n = p.appendNode(n, p.newText(t.val))
+		default:
+			n = p.appendNode(n, p.newText(t.val))
+		}
+	}
+	return n, nil
+}
+
+// emptyBrace is called after an opening delimiter that is not followed by a
+// variable, it returns an error under StrictEmptyBrace if no name was given at
+// all. A name rejected by the lexer, such as ${_}, is still kept as text.
+func (p *Parser) emptyBrace() error {
+	if !p.Restrict.StrictEmptyBrace {
+		return nil
+	}
+	switch p.peek().typ {
+	case itemText, itemError:
+		return nil
+	}
+	return p.errorf("bad substitution: empty variable name")
+}
+
+// deprecated reports the use of op at pos to OnDeprecated if op is deprecated.
+func (p *Parser) deprecated(op string, pos Pos) {
+	if p.Restrict.OnDeprecated != nil && deprecatedOperators[op] {
+		p.Restrict.OnDeprecated(op, pos)
+	}
+}
+
+// suspiciousOperators are the operators looked for after white space by suspicious.
+var suspiciousOperators = []string{":-", ":=", ":+", "^^", ",,", "//", "-", "=", "+", "?", "|", "@", "/"}
+
+// suspicious reports the stray text following the variable of the substitution
+// source, up to its end, to Restrictions.WarnSuspicious if it looks like a
+// mistyped operator.
+func (p *Parser) suspicious(text string, pos Pos, source string) {
+	if p.Restrict.WarnSuspicious == nil {
+		return
+	}
+	op := strings.TrimLeft(text, " \t")
+	if len(op) == len(text) {
+		return
+	}
+	for _, s := range suspiciousOperators {
+		if strings.HasPrefix(op, s) {
+			p.Restrict.WarnSuspicious(fmt.Sprintf("white space before operator %s in %s", s, source), pos)
+			return
+		}
+	}
+	if strings.HasPrefix(op, ":") {
+		p.Restrict.WarnSuspicious(fmt.Sprintf("':' without an operator in %s", source), pos)
+	}
+}
+
+// chainSeparator consumes the ':-' separating the alternatives of a chained
+// default under ChainDefaults and reports whether it was found.
+func (p *Parser) chainSeparator(expType itemType) bool {
+	if !p.Restrict.ChainDefaults || expType != itemColonDash {
+		return false
+	}
+	colon := p.next()
+	if colon.typ != itemText || colon.val != ":" {
+		p.backup()
+		return false
+	}
+	if dash := p.next(); dash.typ != itemText || dash.val != "-" {
+		p.backup2(colon)
+		return false
+	}
+	return true
+}
+
+// isDefaultOperator reports whether typ is one of the default value operators.
+func isDefaultOperator(typ itemType) bool {
+	switch typ {
+	case itemPlus, itemDash, itemEquals, itemColonEquals, itemColonDash, itemColonPlus:
+		return true
+	}
+	return false
+}
+
+// filterSpec collects the source of a filter pipeline up to the closing delimiter,
+// it returns the spec and the position following the delimiter.
+func (p *Parser) filterSpec() (string, Pos, error) {
+	var b strings.Builder
+	for {
+		switch t := p.next(); t.typ {
+		case itemRightDelim:
+			return b.String(), t.pos + Pos(len(t.val)), nil
+		case itemError:
+			return "", 0, p.errorf(t.val)
+		case itemEOF, itemLeftDelim:
+			return "", 0, p.errorf("bad substitution: unexpected " + t.String() + " in filter")
+		default:
+			b.WriteString(t.val)
+		}
+	}
+}
+
+// clock parses the rest of a ${|now:layout} substitution under AllowClock, the
+// layout defaults to RFC 3339.
+func (p *Parser) clock() (Node, error) {
+	p.next() // the '|'
+	spec, _, err := p.filterSpec()
+	if err != nil {
+		return nil, err
+	}
+	name, layout, _ := strings.Cut(spec, ":")
+	if name != "now" {
+		return nil, p.errorf(fmt.Sprintf("bad substitution: unknown clock %q", name))
+	}
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	return &ClockNode{NodeClock, layout, p.Restrict}, nil
+}
+
+// splitPattern splits the "pattern/string" part of a replacement at the first
+// '/' that is not escaped with a backslash.
+func splitPattern(spec string) (pattern, replacement string) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		switch {
+		case spec[i] == '\\' && i+1 < len(spec) && spec[i+1] == '/':
+			b.WriteByte('/')
+			i++
+		case spec[i] == '/':
+			return b.String(), spec[i+1:]
+		default:
+			b.WriteByte(spec[i])
+		}
+	}
+	return b.String(), ""
+}
+
+// column returns the 0-based column, in runes, of pos on its line of the input.
+func (p *Parser) column(pos Pos) int {
+	_, col := LineColumn(p.lex.input, pos)
+	return col - 1
+}
+
+// advance returns the column, in runes, following the text s written at column col.
+func advance(col int, s string) int {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return utf8.RuneCountInString(s[i+1:])
+	}
+	return col + utf8.RuneCountInString(s)
+}
+
+// LineColumn returns the 1-based line and column of the byte position pos in
+// input, such as the Pos of an UnsetVariable. The column counts runes, so a
+// multi-byte character advances it by one. Lines end at '\n', a "\r\n" line end
+// counts once. A position past the end of input is taken as the end.
+func LineColumn(input string, pos Pos) (line, col int) {
+	if int(pos) > len(input) {
+		pos = Pos(len(input))
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	before := input[:pos]
+	start := strings.LastIndexByte(before, '\n') + 1
+	return strings.Count(before, "\n") + 1, utf8.RuneCountInString(before[start:]) + 1
 }
 
 func (p *Parser) errorf(s string) error {
@@ -235,6 +1335,13 @@ func (p *Parser) backup() {
 	p.peekCount++
 }
 
+// backup2 backs the input stream up two tokens.
+// The zeroth token is already there.
+func (p *Parser) backup2(t1 item) {
+	p.token[1] = t1
+	p.peekCount = 2
+}
+
 // peek returns but does not consume the next token.
 func (p *Parser) peek() item {
 	if p.peekCount > 0 {
@@ -1,8 +1,15 @@
 package parse
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+	"unicode"
 )
 
 var FakeEnv = NewEnv([]string{
@@ -26,11 +33,11 @@ const (
 
 // Restrictions specifier
 var (
-	Relaxed   = &Restrictions{false, false, false, false, nil}
-	NoEmpty   = &Restrictions{false, true, false, false, nil}
-	NoUnset   = &Restrictions{true, false, false, false, nil}
-	Strict    = &Restrictions{true, true, false, false, nil}
-	KeepUnset = &Restrictions{false, false, false, true, nil}
+	Relaxed   = &Restrictions{}
+	NoEmpty   = &Restrictions{NoEmpty: true}
+	NoUnset   = &Restrictions{NoUnset: true}
+	Strict    = &Restrictions{NoUnset: true, NoEmpty: true}
+	KeepUnset = &Restrictions{KeepUnset: true}
 )
 
 var restrict = map[mode]*Restrictions{
@@ -59,10 +66,15 @@ var parseTests = []parseTest{
 	{"env only", "$BAR", "bar", errNone},
 	{"with text", "$BAR baz", "bar baz", errNone},
 	{"concatenated", "$BAR$FOO", "barfoo", errNone},
+	{"three adjacent", "$A$BAR$FOO", "AAAbarfoo", errNone},
+	{"three adjacent braced", "${A}${BAR}$FOO", "AAAbarfoo", errNone},
 	{"2 env var", "$BAR - $FOO", "bar - foo", errNone},
 	{"invalid var", "$_ bar", "$_ bar", errNone},
 	{"invalid subst var", "${_} bar", "${_} bar", errNone},
 	{"value of $var", "${BAR}baz", "barbaz", errNone},
+	{"braces bound name before digits", "${BAR}123", "bar123", errNone},
+	{"braces bound name before underscore", "${BAR}_suffix", "bar_suffix", errNone},
+	{"braces bound name of identifier", "${FOO}_${BAR}_table", "foo_bar_table", errNone},
 	{"$var not set -", "${NOTSET-$BAR}", "bar", errNone},
 	{"$var not set =", "${NOTSET=$BAR}", "bar", errNone},
 	{"$var set but empty -", "${EMPTY-$BAR}", "", errEmpty},
@@ -82,6 +94,24 @@ var parseTests = []parseTest{
 	{"gh-issue-41-2", "${NOTSET:--1}", "-1", errNone},
 	{"gh-issue-41-3", "${NOTSET=-1}", "-1", errNone},
 	{"gh-issue-41-4", "${NOTSET:==1}", "=1", errNone},
+	// flag-like defaults
+	{"double dash default :-", "${NOTSET:---flag}", "--flag", errNone},
+	{"double dash default -", "${NOTSET---flag}", "--flag", errNone},
+	{"several flags default", "${NOTSET:---verbose --debug}", "--verbose --debug", errNone},
+	{"space then flags default", "${NOTSET:- --a --b}", " --a --b", errNone},
+	{"flag default for set var", "${BAR:---flag}", "bar", errNone},
+	{"flag alternate", "${BAR:+--flag}", "--flag", errNone},
+
+	// explicit empty defaults
+	{"empty default :-", "${NOTSET:-}", "", errNone},
+	{"empty default -", "${NOTSET-}", "", errNone},
+	{"empty default :=", "${NOTSET:=}", "", errNone},
+	{"empty default =", "${NOTSET=}", "", errNone},
+	{"empty default for set var :-", "${BAR:-}", "bar", errNone},
+	{"empty default for empty var :-", "${EMPTY:-}", "", errNone},
+	{"empty default for empty var -", "${EMPTY-}", "", errEmpty},
+	{"empty alternate +", "${BAR+}", "", errNone},
+	{"empty alternate :+", "${BAR:+}", "", errNone},
 
 	// single letter
 	{"gh-issue-43-1", "${A}", "AAA", errNone},
@@ -95,9 +125,35 @@ var parseTests = []parseTest{
 	{"lowercase with special chars", "${SPECIAL,,}", "hello_world-123", errNone},
 	{"unset variable with uppercase", "${NOTSET^^}", "", errUnset},
 	{"unset variable with lowercase", "${NOTSET,,}", "", errUnset},
+	{"uppercase by pattern", "${BAR^^a}", "bAr", errNone},
+	{"uppercase by class pattern", "${test^^[ts]}", "TeST", errNone},
+	{"uppercase by wildcard pattern", "${test^^?}", "TEST", errNone},
+	{"lowercase by pattern", "${SPECIAL,,H}", "hello_World-123", errNone},
+	{"lowercase by class pattern", "${SPECIAL,,[HW]}", "hello_world-123", errNone},
+	{"pattern without match", "${BAR^^x}", "bar", errNone},
+	{"pattern from variable", "${test^^$A}", "test", errNone},
+	{"unset variable with pattern", "${NOTSET^^a}", "", errUnset},
+	{"bad pattern", "${BAR^^[a}", "", errAll},
+
+	// ternary operator
+	{"ternary set", "${BAR?yes:no}", "yes", errNone},
+	{"ternary empty", "${EMPTY?yes:no}", "no", errNone},
+	{"ternary unset", "${NOTSET?yes:no}", "no", errNone},
+	{"ternary with variables", "${BAR?$FOO:$A}", "foo", errNone},
+	{"ternary else with colon", "${NOTSET?yes:a:b}", "a:b", errNone},
+	{"ternary without else", "${NOTSET?yes}", "", errNone},
+	{"ternary empty then", "${BAR?:no}", "", errNone},
 
 	// bad substitution
 	{"closing brace expected", "hello ${", "", errAll},
+	{"bare colon", "${BAR:}", "", errAll},
+	{"bare colon with space", "${BAR: }", "", errAll},
+	{"bare colon unset", "${NOTSET:}", "", errAll},
+
+	// substitutions without a variable name are kept as text
+	{"empty braces", "${}", "${}", errNone},
+	{"empty braces with operator", "${:-x}", "${:-x}", errNone},
+	{"empty braces in default", "${NOTSET:-${}}", "${}", errNone},
 
 	// test specifically for failure modes
 	{"$var not set", "${NOTSET}", "", errUnset},
@@ -139,6 +195,37 @@ var parseTests = []parseTest{
 	{"escape $${subst}", "FOO $${BAR} BAZ", "FOO ${BAR} BAZ", errNone},
 	{"escape $$$var", "$$$BAR", "$bar", errNone},
 	{"escape $$${subst}", "$$${BAZ:-baz}", "$baz", errNone},
+	{"escape $$ in default", "${NOTSET:-$$5}", "$5", errNone},
+	{"lone $ before space in default", "${NOTSET:-$ }", "$ ", errNone},
+	{"lone $ before punctuation in default", "${NOTSET:-$-}", "$-", errNone},
+	{"unset $5 in default text", "${NOTSET:-cost is $5}", "cost is $5", errNone},
+	{"variable then text in default", "${NOTSET:-$BAR x}", "bar x", errNone},
+	{"text around nested substitution in default", "${NOTSET:-x ${BAR} y}", "x bar y", errNone},
+	{"nested substitution then variable in default", "${NOTSET:-${FOO}$BAR}", "foobar", errNone},
+	{"assignment seen by default text", "${NOTSET2:=5} ${NOTSET:-a $NOTSET2}", "5 a 5", errNone},
+	{"escape $${subst} in default", "${NOTSET:-a$${B}}", "a${B}", errNone},
+	{"escape $$$var in default", "${NOTSET:-$$$BAR}", "$bar", errNone},
+	{"escape $$ in alternate", "${BAR:+$$$$}", "$$", errNone},
+
+	// escaping at EOF.
+	{"lone $ at EOF", "cost $", "cost $", errNone},
+	{"escape $$ at EOF", "cost $$", "cost $", errNone},
+	{"escape $$$ at EOF", "cost $$$", "cost $$", errNone},
+	{"escape $$$$ at EOF", "$$$$", "$$", errNone},
+	{"lone $ before text", "$ $$ $$$", "$ $ $$", errNone},
+	{"lone $ in default", "${NOTSET:-$}", "$", errNone},
+	{"lone $ in default text", "${NOTSET:-a$}", "a$", errNone},
+
+	// a '}' outside of a substitution is text.
+	{"brace after substitution", "text ${BAR}}", "text bar}", errNone},
+	{"braces after substitution", "${BAR}}}", "bar}}", errNone},
+	{"brace before substitution", "}${BAR}", "}bar", errNone},
+	{"braces around variable", "{$BAR}", "{bar}", errNone},
+	{"brace after variable", "}$BAR}", "}bar}", errNone},
+	{"brace after adjacent substitutions", "${BAR}${FOO}}", "barfoo}", errNone},
+	{"brace after default", "${NOTSET:-x}}", "x}", errNone},
+	{"brace after nested substitution", "${NOTSET:-${BAR}}}", "bar}", errNone},
+	{"lone braces", "}} a}b", "}} a}b", errNone},
 
 	// Enhanced functionality tests
 	{"nested expansions level 1", "${NOTSET:-${FOO}}", "foo", errNone},
@@ -171,8 +258,22 @@ var keepUnsetTests = []parseTest{
 	// Pattern transformer tests with KeepUnset
 	{"keep unset uppercase pattern", "${NOTSET^^}", "${NOTSET^^}", errNone},
 	{"keep unset lowercase pattern", "${NOTSET,,}", "${NOTSET,,}", errNone},
+	{"keep unset uppercase pattern with match", "${NOTSET^^a}", "${NOTSET^^a}", errNone},
 	{"transform set uppercase pattern", "${BAR^^}", "BAR", errNone},
 	{"transform set lowercase pattern", "${FOO,,}", "foo", errNone},
+	// set but empty variables are substituted, only unset ones are kept
+	{"substitute empty variable", "[$EMPTY]", "[]", errNone},
+	{"substitute empty substitution", "[${EMPTY}]", "[]", errNone},
+	{"substitute empty next to unset", "$EMPTY$NOTSET", "$NOTSET", errNone},
+	{"substitute empty with dash default", "[${EMPTY-default}]", "[]", errNone},
+	{"substitute empty with equals default", "[${EMPTY=default}]", "[]", errNone},
+	{"substitute empty with plus", "${EMPTY+replacement}", "replacement", errNone},
+	{"substitute empty with colon plus", "[${EMPTY:+replacement}]", "[]", errNone},
+	{"substitute empty pattern", "[${EMPTY^^}]", "[]", errNone},
+	{"substitute empty filter", "[${EMPTY|pad:2}]", "[  ]", errNone},
+	{"substitute empty ternary", "${EMPTY?set:unset}", "unset", errNone},
+	{"substitute empty in default", "[${NOTSET:-$EMPTY}]", "[]", errNone},
+	{"keep unset before brace", "${NOTSET}} $NOTSET}", "${NOTSET}} $NOTSET}", errNone},
 }
 
 func TestParse(t *testing.T) {
@@ -274,6 +375,32 @@ var varMatcherTests = []struct {
 		func(v string) bool { return !strings.Contains(v, "_") }, false}, // VAR_1 and VAR_2 have underscores, test doesn't
 	{"empty variable name handling", "${} $BAR", "${} bar",
 		func(v string) bool { return v != "" }, false}, // Empty variable name doesn't match, BAR does
+	{"adjacent variables with middle rejected", "$A$BAR$FOO", "AAA$BARfoo",
+		func(v string) bool { return v != "BAR" }, false}, // BAR stays text between its neighbours
+	{"adjacent substitutions with middle rejected", "${A}${BAR}${FOO}", "AAA${BAR}foo",
+		func(v string) bool { return v != "BAR" }, false},
+	{"accepted outer, rejected inner variable", "${NOTSET:-$BAR}", "$BAR",
+		func(v string) bool { return v == "NOTSET" }, false},
+	{"accepted outer, rejected inner substitution", "${NOTSET:-${BAR}}", "${BAR}",
+		func(v string) bool { return v == "NOTSET" }, false},
+	{"accepted outer, rejected inner substitution with default", "${NOTSET:-${BAR:-x}y}", "${BAR:-x}y",
+		func(v string) bool { return v == "NOTSET" }, false},
+	{"rejected outer, accepted inner variable", "${NOTSET:-$BAR}", "${NOTSET:-bar}",
+		func(v string) bool { return v == "BAR" }, false},
+	{"rejected outer, accepted inner substitution", "${NOTSET:-${BAR}}", "${NOTSET:-bar}",
+		func(v string) bool { return v == "BAR" }, false},
+	{"accepted, rejected, accepted", "${NOTSET:-${FOO:-${BAR}}}", "${FOO:-bar}",
+		func(v string) bool { return v != "FOO" }, false},
+	{"rejected, accepted, rejected", "${NOTSET:-${FOO:-$BAR}}", "${NOTSET:-foo}",
+		func(v string) bool { return v == "FOO" }, false},
+	{"rejected variable before accepted variable", "$FOO$BAR", "$FOObar",
+		func(v string) bool { return v != "FOO" }, false},
+	{"rejected variable before escaped dollar", "$FOO$$x", "$FOO$x",
+		func(v string) bool { return v != "FOO" }, false},
+	{"escaped dollar before rejected variable", "$$$FOO$BAR", "$$FOObar",
+		func(v string) bool { return v != "FOO" }, false},
+	{"rejected variable before trailing dollar", "$FOO$", "$FOO$",
+		func(v string) bool { return v != "FOO" }, false},
 }
 
 // TestVarMatcher tests the VarMatcher functionality in the parser
@@ -393,3 +520,1441 @@ func TestVarMatcherEdgeCases(t *testing.T) {
 		})
 	}
 }
+
+// TestMatchRegexp tests the regexp based VarMatcher helper
+func TestMatchRegexp(t *testing.T) {
+	testEnv := NewEnv([]string{"APP_NAME=app", "APP_1=one", "BAR=bar"})
+	matcher, err := MatchRegexp(`^APP_[A-Z]+$`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name, input, expected string
+	}{
+		{"matching variable", "$APP_NAME", "app"},
+		{"matching substitution", "${APP_NAME:-x}", "app"},
+		{"digits rejected", "$APP_1 ${APP_1}", "$APP_1 ${APP_1}"},
+		{"other prefix rejected", "$BAR ${BAR:-x}", "$BAR ${BAR:-x}"},
+		{"matching unset variable", "${APP_UNSET:-x}", "x"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, &Restrictions{VarMatcher: matcher}).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	if _, err := MatchRegexp(`APP_[`); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+// TestVarRunePredicates tests parsing with custom IsVarStart/IsVarPart predicates
+func TestVarRunePredicates(t *testing.T) {
+	testEnv := NewEnv([]string{"A=a", "A1=a1", "1=one", "_B=b"})
+	noDigits := func(r rune) bool { return r == '_' || unicode.IsLetter(r) }
+
+	tests := []struct {
+		name, input, expected string
+		start, part           func(rune) bool
+	}{
+		{"default accepts digits", "$A1 $1", "a1 one", nil, nil},
+		{"digits forbidden in names", "$A1", "a1", noDigits, noDigits},
+		{"digits forbidden as start", "$1 ${1}", "$1 ${1}", noDigits, noDigits},
+		{"underscore still allowed", "$_B", "b", noDigits, noDigits},
+		{"only start predicate", "$1 $A1", "$1 a1", noDigits, nil},
+		{"digits forbidden as start in default", "${X:-$1abc} ${X:-${1}}", "$1abc ${1}", noDigits, nil},
+		{"variable in default", "${X:-x$A1.$_B}", "xa1.b", noDigits, nil},
+		{"lone sigil in default", "${X:-$} ${X:-$ x}", "$ $ x", noDigits, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := New(test.name, testEnv, &Restrictions{IsVarStart: test.start, IsVarPart: test.part})
+			result, err := parser.Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestDoubleBraceEscape tests "}}" as a literal brace in substitution values
+func TestDoubleBraceEscape(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"doubled brace in default", "${NOTSET:-a}}b}", "a}b", false},
+		{"only doubled braces", "${NOTSET:-}}}}}", "}}", false},
+		{"set variable ignores default", "${BAR:-a}}b}", "bar", false},
+		{"closing brace follows the variable", "${BAR}}", "bar}", false},
+		{"alternate value", "${BAR+{x}}}", "{x}", false},
+		{"nested substitution closes on single brace", "${NOTSET:-${FOO}}", "foo", false},
+		{"nested default closes both", "${NOTSET:-${UNSET:-a}}", "a", false}, // the inner "}" closes ${UNSET} before "}}" could be read as escape
+		{"unterminated", "${NOTSET:-a}}", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{DoubleBraceEscape: true}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	// without the option the first '}' closes the substitution
+	result, err := New("off", FakeEnv, &Restrictions{}).Parse("${NOTSET:-a}}b}")
+	if err != nil || result != "a}b}" {
+		t.Errorf("expected %q, got %q (%v)", "a}b}", result, err)
+	}
+}
+
+// TestParseWithEnv tests that assignments are returned in a copy of the Env
+func TestParseWithEnv(t *testing.T) {
+	env := NewEnv([]string{"A=a", "EMPTY="})
+	parser := New("assign", env, &Restrictions{})
+
+	result, out, err := parser.ParseWithEnv("${X:=5} ${EMPTY:=e} ${A:=b} ${Y=${Z:=z}} ${W:-w} $X")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "5 e a z w 5"; result != expected {
+		t.Errorf("Result mismatch:\nGot:      %q\nExpected: %q", result, expected)
+	}
+	for key, expected := range map[string]string{"X": "5", "EMPTY": "e", "A": "a", "Y": "z", "Z": "z"} {
+		if got := out.Get(key); got != expected {
+			t.Errorf("expected %s=%q in the returned env, got %q", key, expected, got)
+		}
+	}
+	if out.Has("W") {
+		t.Error("expected :- not to assign W")
+	}
+	if env.Has("X") || env.Get("EMPTY") != "" {
+		t.Errorf("expected the parser env to be untouched, got %q", env.Strings())
+	}
+	if parser.Restrict.assign {
+		t.Error("expected the parser restrictions to be untouched")
+	}
+}
+
+// TestNoDigitInDefault tests that NoDigit applies to default values as it does
+// at the top level, and that an unset positional default is kept as written
+func TestNoDigitInDefault(t *testing.T) {
+	tests := []struct {
+		input, expected string
+		noDigit         bool
+	}{
+		{"${NOTSET:-$5}", "$5", true},
+		{"${NOTSET:-$5x} $5", "$5x $5", true},
+		{"${NOTSET:-${5}}", "${5}", true},
+		{"${NOTSET:-$5}", "$5", false},
+		{"${NOTSET:-$5} $5", "$5 ", false},
+		{"${NOTSET:-$5}|${NOTSET:-cost is $5}", "$5|cost is $5", false},
+		{"${NOTSET:-$BAR$5}", "bar$5", false},
+	}
+
+	for _, test := range tests {
+		result, err := New("no digit", FakeEnv, &Restrictions{NoDigit: test.noDigit}).Parse(test.input)
+		if err != nil || result != test.expected {
+			t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q\nError:    %v", test.input, result, test.expected, err)
+		}
+	}
+
+	if result, err := New("set", NewEnv([]string{"5=five"}), &Restrictions{}).Parse("${NOTSET:-$5}"); err != nil || result != "five" {
+		t.Errorf("expected a set positional default to be used, got %q, %v", result, err)
+	}
+}
+
+func TestLineColumn(t *testing.T) {
+	input := "a: $A\r\nb: ${B}\nüñí $C\n"
+	tests := []struct {
+		name      string
+		pos       Pos
+		line, col int
+	}{
+		{"input start", 0, 1, 1},
+		{"mid-line", 3, 1, 4},
+		{"carriage return", 5, 1, 6},
+		{"line feed of CRLF", 6, 1, 7},
+		{"after CRLF", 7, 2, 1},
+		{"second line", 10, 2, 4},
+		{"third line start", 15, 3, 1},
+		{"after multi-byte runes", 22, 3, 5},
+		{"EOF", Pos(len(input)), 4, 1},
+		{"past EOF", Pos(len(input) + 10), 4, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, col := LineColumn(input, test.pos)
+			if line != test.line || col != test.col {
+				t.Errorf("LineColumn(%d): expected %d:%d, got %d:%d", test.pos, test.line, test.col, line, col)
+			}
+		})
+	}
+
+	if line, col := LineColumn("", 0); line != 1 || col != 1 {
+		t.Errorf("expected 1:1 for empty input, got %d:%d", line, col)
+	}
+	unset, _ := New("test", FakeEnv, &Restrictions{}).UnsetAt(input)
+	if line, col := LineColumn(input, unset[1].Pos); line != 3 || col != 6 {
+		t.Errorf("expected $C at 3:6, got %d:%d", line, col)
+	}
+}
+
+// TestInvalidUTF8 tests that the bytes around substitutions are kept even if
+// they are not valid UTF-8, as in a Latin-1 file
+func TestInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+	}{
+		{"around variables", "caf\xe9 $BAR\xe9 \xff${FOO}\xfe", "caf\xe9 bar\xe9 \xfffoo\xfe"},
+		{"escape", "\xe9$$\xe9 $\xe9", "\xe9$\xe9 $\xe9"},
+		{"truncated sequence", "${BAR^^}\xc3", "BAR\xc3"},
+		{"in default", "${NOTSET:-\xe9$BAR\xff}", "\xe9bar\xff"},
+		{"no variables", "\x00\xe9\xff\xfe", "\x00\xe9\xff\xfe"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{}).Parse(test.input)
+			if err != nil || result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q\nError:    %v", test.input, result, test.expected, err)
+			}
+		})
+	}
+}
+
+// TestAssignment tests that only the := and = operators assign their default,
+// for the rest of the input with Parse and in the returned Env with ParseWithEnv
+func TestAssignment(t *testing.T) {
+	tests := []struct {
+		op       string
+		unset    string // output of "${X<op>d}:$X" with X unset
+		empty    string // ... with X=""
+		set      string // ... with X="x"
+		assigned [3]bool
+	}{
+		{":=", "d:d", "d:d", "x:x", [3]bool{true, true, false}},
+		{"=", "d:d", ":", "x:x", [3]bool{true, false, false}},
+		{":-", "d:", "d:", "x:x", [3]bool{}},
+		{"-", "d:", ":", "x:x", [3]bool{}},
+		{":+", ":", ":", "d:x", [3]bool{}},
+		{"+", ":", "d:", "d:x", [3]bool{}},
+	}
+
+	for _, test := range tests {
+		for i, env := range [][]string{nil, {"X="}, {"X=x"}} {
+			expected := [3]string{test.unset, test.empty, test.set}[i]
+			input := "${X" + test.op + "d}:$X"
+			t.Run(fmt.Sprintf("%s %q", input, env), func(t *testing.T) {
+				e := NewEnv(env)
+				parser := New("assign", e, &Restrictions{})
+				result, err := parser.Parse(input)
+				if err != nil || result != expected {
+					t.Errorf("Parse: expected %q, got %q, %v", expected, result, err)
+				}
+				if e.Has("X") != (env != nil) {
+					t.Error("Parse must not modify the Env")
+				}
+
+				result, out, err := parser.ParseWithEnv(input)
+				if err != nil || result != expected {
+					t.Errorf("ParseWithEnv: expected %q, got %q, %v", expected, result, err)
+				}
+				if got := out.Has("X") && out.Get("X") == "d"; got != test.assigned[i] {
+					t.Errorf("ParseWithEnv: expected assigned=%v, got X=%q", test.assigned[i], out.Get("X"))
+				}
+			})
+		}
+	}
+
+	// assignments do not carry over to the next Parse
+	parser := New("assign", NewEnv(nil), &Restrictions{})
+	parser.Parse("${X:=d}")
+	if result, _ := parser.Parse("[$X]"); result != "[]" {
+		t.Errorf("expected a fresh parse, got %q", result)
+	}
+}
+
+// TestParseTimeout tests that ParseTimeout gives up on slow rendering
+func TestParseTimeout(t *testing.T) {
+	original := patternDefinitions[itemCaretCaret]
+	release, finished := make(chan struct{}), make(chan struct{})
+	patternDefinitions[itemCaretCaret] = PatternDefinition{Operator: "^^", Transformer: func(v string) string {
+		<-release
+		close(finished)
+		return strings.ToUpper(v)
+	}}
+	defer func() { patternDefinitions[itemCaretCaret] = original }()
+
+	parser := New("slow", FakeEnv, &Restrictions{})
+	_, err := parser.ParseTimeout("${BAR^^}", 10*time.Millisecond)
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if !errors.Is(err, Error("", "Timeout")) {
+		t.Errorf("expected Timeout error, got %v", err)
+	}
+	close(release)
+	<-finished
+
+	result, err := parser.ParseTimeout("$BAR", time.Second)
+	if err != nil || result != "bar" {
+		t.Errorf("expected %q without error, got %q, %v", "bar", result, err)
+	}
+}
+
+// TestLongestMatch tests the LongestMatch restriction for bare variables
+func TestLongestMatch(t *testing.T) {
+	testEnv := NewEnv([]string{"HOST=h", "HOST_NAME=hn", "H=x"})
+
+	tests := []struct {
+		name, input, expected string
+		longest               bool
+	}{
+		{"greedy unset", "$HOSTNAME", "", false},
+		{"greedy set", "$HOST_NAME", "hn", false},
+		{"greedy braces", "${HOST}NAME", "hNAME", false},
+		{"longest prefix", "$HOSTNAME", "hNAME", true},
+		{"longest prefix prefers longer", "$HOST_NAMES", "hnS", true},
+		{"exact match kept", "$HOST_NAME", "hn", true},
+		{"no prefix set", "$NOPE", "", true},
+		{"braces are not affected", "${HOSTNAME}", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, &Restrictions{LongestMatch: test.longest}).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestTrailingNewline tests the TrailingNewline output policy
+func TestTrailingNewline(t *testing.T) {
+	testEnv := NewEnv([]string{"NL=value\n\n", "V=value"})
+
+	tests := []struct {
+		name, input, expected string
+		policy                NewlinePolicy
+	}{
+		{"keep none", "a: $V", "a: value", NewlineKeep},
+		{"keep several", "a: $V\n\n\n", "a: value\n\n\n", NewlineKeep},
+		{"ensure adds one", "a: $V", "a: value\n", NewlineEnsure},
+		{"ensure keeps existing", "a: $V\n\n", "a: value\n\n", NewlineEnsure},
+		{"ensure empty input", "", "\n", NewlineEnsure},
+		{"strip to one", "a: $V\n\n\n", "a: value\n", NewlineStrip},
+		{"strip without newline", "a: ${V}", "a: value", NewlineStrip},
+		{"strip value at EOF", "a: $NL", "a: value\n", NewlineStrip},
+		{"ensure value at EOF", "a: ${NL}", "a: value\n\n", NewlineEnsure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, &Restrictions{TrailingNewline: test.policy}).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestNewDoesNotMutateRestrictions tests that New copies the given restrictions
+func TestNewDoesNotMutateRestrictions(t *testing.T) {
+	r := &Restrictions{NoUnset: true, NoEmpty: true, KeepUnset: true}
+	parser := New("test", FakeEnv, r)
+
+	if !r.NoUnset || !r.NoEmpty || !r.KeepUnset {
+		t.Errorf("caller restrictions were modified: %+v", *r)
+	}
+	effective := parser.Restrictions()
+	if effective.NoUnset || effective.NoEmpty || !effective.KeepUnset {
+		t.Errorf("unexpected effective restrictions: %+v", effective)
+	}
+	if parser.Restrict == r {
+		t.Error("parser should not share the caller restrictions")
+	}
+
+	if got := New("nil", FakeEnv, nil).Restrictions(); got.NoUnset || got.NoEmpty || got.KeepUnset {
+		t.Errorf("expected zero restrictions for nil, got %+v", got)
+	}
+}
+
+// TestNewSharedRestrictions tests that parsers built from one Restrictions are independent
+func TestNewSharedRestrictions(t *testing.T) {
+	shared := &Restrictions{NoUnset: true}
+
+	shared.KeepUnset = true
+	keep := New("keep", FakeEnv, shared)
+	shared.KeepUnset = false
+	strict := New("strict", FakeEnv, shared)
+
+	if result, err := keep.Parse("${NOTSET}"); err != nil || result != "${NOTSET}" {
+		t.Errorf("keep parser: expected %q without error, got %q, %v", "${NOTSET}", result, err)
+	}
+	if _, err := strict.Parse("${NOTSET}"); err == nil {
+		t.Error("strict parser: expected NoUnset error, NoUnset was cleared by the KeepUnset parser")
+	}
+	if !shared.NoUnset {
+		t.Error("shared restrictions were modified")
+	}
+}
+
+// TestAllowUnderscoreVar tests the AllowUnderscoreVar restriction
+func TestAllowUnderscoreVar(t *testing.T) {
+	testEnv := NewEnv([]string{"_=/usr/bin/env", "BAR=bar"})
+
+	tests := []struct {
+		name, input, expected string
+		allow                 bool
+	}{
+		{"bare rejected", "$_ $BAR", "$_ bar", false},
+		{"braced rejected", "${_} $BAR", "${_} bar", false},
+		{"bare allowed", "$_ $BAR", "/usr/bin/env bar", true},
+		{"braced allowed", "${_} $BAR", "/usr/bin/env bar", true},
+		{"longer names unaffected", "$_BAR", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, &Restrictions{AllowUnderscoreVar: test.allow}).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestParseNoVarsFastPath tests that input without '$' is returned unchanged without allocating
+func TestParseNoVarsFastPath(t *testing.T) {
+	parser := New("fast", FakeEnv, &Restrictions{NoUnset: true})
+	for _, input := range []string{"", "plain text", "multi\nline {braces} and }\n", "a: {b}\n\n"} {
+		result, err := parser.Parse(input)
+		if err != nil || result != input {
+			t.Errorf("expected %q without error, got %q, %v", input, result, err)
+		}
+	}
+
+	input := strings.Repeat("no variables here\n", 100)
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := parser.Parse(input); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations for input without variables, got %v", allocs)
+	}
+
+	ensure := New("fast", FakeEnv, &Restrictions{TrailingNewline: NewlineEnsure})
+	if result, _ := ensure.Parse("text"); result != "text\n" {
+		t.Errorf("expected the newline policy to apply on the fast path, got %q", result)
+	}
+}
+
+func BenchmarkParseNoVars(b *testing.B) {
+	parser := New("bench", FakeEnv, &Restrictions{})
+	input := strings.Repeat("no variables here, just plain configuration text\n", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.Parse(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseVars(b *testing.B) {
+	parser := New("bench", FakeEnv, &Restrictions{})
+	input := strings.Repeat("host=$BAR port=${FOO} name=${NOTSET:-default}\n", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.Parse(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseEscapes(b *testing.B) {
+	parser := New("bench", FakeEnv, &Restrictions{})
+	input := strings.Repeat("price: $$5 and $${LITERAL}\n", 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.Parse(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseAppend compares ParseAppend reusing its buffer with Parse
+func BenchmarkParseAppend(b *testing.B) {
+	input := strings.Repeat("host=$BAR port=${FOO} name=${NOTSET:-default}\n", 100)
+
+	b.Run("Parse", func(b *testing.B) {
+		parser := New("bench", FakeEnv, &Restrictions{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := parser.Parse(input); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ParseAppend", func(b *testing.B) {
+		parser := New("bench", FakeEnv, &Restrictions{})
+		var buf []byte
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var err error
+			if buf, err = parser.ParseAppend(buf[:0], input); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestParsePartial tests that ParsePartial returns the output rendered before an error
+func TestParsePartial(t *testing.T) {
+	tests := []struct {
+		name, input, expected, errMsg string
+		mode                          Mode
+	}{
+		{"unset mid-template", "host=$BAR\nuser=$NOTSET\nport=$FOO", "host=bar\nuser=", "variable ${NOTSET} not set", Quick},
+		{"error first", "$NOTSET $BAR", "", "variable ${NOTSET} not set", Quick},
+		{"syntax error", "host=$BAR\nport=${FOO", "host=bar\nport=", "closing brace expected", Quick},
+		{"unset before syntax error", "$NOTSET ${FOO", "", "variable ${NOTSET} not set", Quick},
+		{"all errors", "$NOTSET,$BAR,$EMPTY", ",bar,", "variable ${NOTSET} not set\nvariable ${EMPTY} set but empty", AllErrors},
+		{"no error", "$BAR $FOO", "bar foo", "", Quick},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := New(test.name, FakeEnv, &Restrictions{NoUnset: true, NoEmpty: true})
+			parser.Mode = test.mode
+			result, err := parser.ParsePartial(test.input)
+			if test.errMsg == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.errMsg != "" && (err == nil || err.Error() != test.errMsg) {
+				t.Fatalf("expected error %q, got %v", test.errMsg, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+			// Parse still discards the output
+			if result, _ := parser.Parse(test.input); test.errMsg != "" && result != "" {
+				t.Errorf("expected Parse to discard the output, got %q", result)
+			}
+		})
+	}
+}
+
+// TestParseAppend tests that ParseAppend appends the output of Parse to the buffer
+func TestParseAppend(t *testing.T) {
+	tests := []struct {
+		name, input string
+		r           *Restrictions
+	}{
+		{"variables", "host=$BAR port=${FOO} name=${NOTSET:-default}", &Restrictions{}},
+		{"no variables", "plain text", &Restrictions{}},
+		{"escapes", "$$BAR", &Restrictions{}},
+		{"preprocess", "a\r\n$BAR\r\n", &Restrictions{Preprocess: func(s string) string { return strings.ReplaceAll(s, "\r\n", "\n") }}},
+		{"trailing newline", "$BAR", &Restrictions{TrailingNewline: NewlineEnsure}},
+		{"postprocess", "$BAR", &Restrictions{Postprocess: func(s string) (string, error) { return strings.ToUpper(s), nil }}},
+		{"keep unset", "$BAR $NOTSET", &Restrictions{KeepUnset: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected, err := New(test.name, FakeEnv, test.r).Parse(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := append(make([]byte, 0, 64), "prefix:"...)
+			result, err := New(test.name, FakeEnv, test.r).ParseAppend(buf, test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(result) != "prefix:"+expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, "prefix:"+expected)
+			}
+		})
+	}
+
+	parser := New("reuse", FakeEnv, &Restrictions{NoUnset: true})
+	buf, err := parser.ParseAppend(nil, "$BAR,")
+	if err == nil {
+		buf, err = parser.ParseAppend(buf, "$FOO")
+	}
+	if err != nil || string(buf) != "bar,foo" {
+		t.Errorf("expected %q, got %q, %v", "bar,foo", buf, err)
+	}
+	result, err := parser.ParseAppend(buf, "$NOTSET")
+	if err == nil || string(result) != "bar,foo" {
+		t.Errorf("expected an error and the buffer unchanged, got %q, %v", result, err)
+	}
+
+	// the storage of the nodes is reused by the next ParseAppend, with fresh nodes
+	r := &Restrictions{OnMissing: func(name string) (string, bool) { return "asked", name == "ASK" }, LongestMatch: true, KeepMalformed: true}
+	parser = New("storage", FakeEnv, r)
+	for _, input := range []string{
+		strings.Repeat("$ASK ${BAR:-d} [$NOTSET] ", 20),
+		"${NOTSET:-x $FOO} $ASK",
+		strings.Repeat("a ${FOO?y:n} ${NOTSET:=$BAR} $NOTSET\n", 50),
+		strings.Repeat("$BARx ${A|nofilter} ${A%x} ${NOTSET:-${ x}\n", 20),
+	} {
+		expected, err := New("storage", FakeEnv, r).Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := parser.ParseAppend(nil, input); err != nil || string(result) != expected {
+			t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q, %v\nExpected: %q", input, result, err, expected)
+		}
+	}
+}
+
+// TestSigil tests substitution with a custom sigil
+func TestSigil(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		sigil                 rune
+	}{
+		{"bare", "hello @BAR", "hello bar", '@'},
+		{"braced", "hello @{BAR}baz", "hello barbaz", '@'},
+		{"braced default", "@{NOTSET:-@FOO}", "foo", '@'},
+		{"nested", "@{NOTSET:-@{FOO^^}}", "FOO", '@'},
+		{"escaped bare", "@@BAR", "@BAR", '@'},
+		{"escaped braced", "@@{BAR}", "@{BAR}", '@'},
+		{"dollar is text", "$BAR ${FOO} $$", "$BAR ${FOO} $$", '@'},
+		{"percent", "%BAR-%{FOO}", "bar-foo", '%'},
+		{"multi-byte sigil", "§BAR §{FOO} §§A", "bar foo §A", '§'},
+		{"default sigil", "$BAR @BAR", "bar @BAR", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{Sigil: test.sigil}).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	result, err := New("keep", FakeEnv, &Restrictions{Sigil: '@', KeepUnset: true}).Parse("@NOTSET @{NOTSET} @{NOTSET^^}")
+	if expected := "@NOTSET @{NOTSET} @{NOTSET^^}"; err != nil || result != expected {
+		t.Errorf("expected %q without error, got %q, %v", expected, result, err)
+	}
+}
+
+// TestStrictEmptyBrace tests substitutions without a variable name
+func TestStrictEmptyBrace(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		strict, hasErr        bool
+	}{
+		{"empty braces", "a ${} b", "a ${} b", false, false},
+		{"empty name with operator", "${:-x}", "${:-x}", false, false},
+		{"strict empty braces", "a ${} b", "", true, true},
+		{"strict empty name with operator", "${:-x}", "", true, true},
+		{"strict empty braces in default", "${NOTSET:-${}}", "", true, true},
+		{"strict rejected name kept", "${_} $BAR", "${_} bar", true, false},
+		{"strict valid substitution", "${BAR:-x}", "bar", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{StrictEmptyBrace: test.strict}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestStrictSubst tests that StrictSubst rejects text following the variable name in braces
+func TestStrictSubst(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		strict, hasErr        bool
+	}{
+		{"junk ignored", "${BAR junk}", "bar", false, false},
+		{"junk", "${BAR junk}", "", true, true},
+		{"space before operator", "${BAR :-x}", "", true, true},
+		{"colon without operator", "${NOTSET :x}", "", true, true},
+		{"punctuation", "${BAR.x}", "", true, true},
+		{"junk in default", "${NOTSET:-${BAR junk}}", "", true, true},
+		{"default", "${BAR:-junk}", "bar", true, false},
+		{"default with spaces", "${NOTSET:- junk junk}", " junk junk", true, false},
+		{"plain", "$BAR ${FOO}", "bar foo", true, false},
+		{"space before brace", "${BAR }", "bar", true, false},
+		{"ternary", "${BAR?yes:no}", "yes", true, false},
+		{"filter", "${BAR|pad:4}", "bar ", true, false},
+		{"replace", "${BAR/a/o}", "bor", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{StrictSubst: test.strict}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	_, err := New("message", FakeEnv, &Restrictions{StrictSubst: true}).Parse("a ${BAR junk} b")
+	if expected := "bad substitution: unexpected text after the variable in ${BAR junk}"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+// TestKeepMalformed tests that KeepMalformed keeps substitutions that fail to parse as text
+func TestKeepMalformed(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"unknown filter", "${BAR|nofilter} $FOO", "${BAR|nofilter} foo", false},
+		{"unknown operator", "a ${A%x} ${FOO}", "a ${A%x} foo", false},
+		{"unknown colon operator", "a ${BAR:x} ${FOO}", "a ${BAR:x} foo", false},
+		{"text after the variable", "${BAR junk}$FOO", "${BAR junk}foo", false},
+		{"nested unknown operator", "${NOTSET:-${BAR#x}} $FOO", "${NOTSET:-${BAR#x}} foo", false},
+		{"unterminated brace", "${BAR $FOO", "${BAR foo", false},
+		{"unterminated brace at end", "x ${BAR", "x ${BAR", false},
+		{"unterminated brace on its line", "${BAR\n$FOO}", "${BAR\nfoo}", false},
+		{"nested", "${NOTSET:-${BAR|nofilter}} $FOO", "${NOTSET:-${BAR|nofilter}} foo", false},
+		{"several", "${BAR|x}${FOO|y}$A", "${BAR|x}${FOO|y}AAA", false},
+		{"multi-byte", "${BAR|ñ} é $FOO", "${BAR|ñ} é foo", false},
+		{"valid", "${BAR:-x} ${NOTSET:-y}", "bar y", false},
+		{"coded error", "${BAR|nofilter} ${FOO:-x}", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Restrictions{KeepMalformed: true, NoDefaults: test.hasErr}
+			result, err := New(test.name, FakeEnv, r).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	for _, input := range []string{"${BAR|nofilter}", "${BAR"} {
+		if _, err := New("default", FakeEnv, &Restrictions{}).Parse(input); err == nil {
+			t.Errorf("%q: expected an error without KeepMalformed", input)
+		}
+	}
+}
+
+// TestClock tests the ${|now:layout} substitution under AllowClock
+func TestClock(t *testing.T) {
+	fixed := func() time.Time { return time.Date(2024, time.March, 5, 14, 7, 9, 0, time.UTC) }
+	tests := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"date", "${|now:2006-01-02}", "2024-03-05", false},
+		{"layout with colons", "at ${|now:15:04:05}", "at 14:07:09", false},
+		{"default layout", "${|now}", "2024-03-05T14:07:09Z", false},
+		{"empty layout", "${|now:}", "2024-03-05T14:07:09Z", false},
+		{"default of unset", "${NOTSET:-${|now:2006}}", "2024", false},
+		{"default of set", "${BAR:-${|now:2006}}", "bar", false},
+		{"chained default", "${NOTSET:-$ALSO_NOTSET:-${|now:Jan 2}}", "Mar 5", false},
+		{"unknown clock", "${|later}", "", true},
+		{"unterminated", "${|now", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Restrictions{AllowClock: true, Now: fixed, ChainDefaults: true}
+			result, err := New(test.name, FakeEnv, r).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	result, err := New("disabled", FakeEnv, &Restrictions{Now: fixed}).Parse("${|now:2006} ${NOTSET:-${|now:2006}}")
+	if expected := "${|now:2006} ${|now:2006}"; err != nil || result != expected {
+		t.Errorf("expected %q without AllowClock, got %q, %v", expected, result, err)
+	}
+
+	before := time.Now().Truncate(time.Second)
+	result, err = New("real clock", FakeEnv, &Restrictions{AllowClock: true}).Parse("${|now}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if now, err := time.Parse(time.RFC3339, result); err != nil || now.Before(before) {
+		t.Errorf("expected the current time, got %q, %v", result, err)
+	}
+}
+
+// TestNoDollarEscape tests that NoDollarEscape handles each '$' on its own
+func TestNoDollarEscape(t *testing.T) {
+	tests := []struct {
+		name, input, escaped, unescaped string
+	}{
+		{"variable", "$$BAR", "$BAR", "$bar"},
+		{"substitution", "$${BAR}", "${BAR}", "$bar"},
+		{"lone", "cost $$", "cost $", "cost $$"},
+		{"triple", "$$$BAR", "$bar", "$$bar"},
+		{"digit", "$$5", "$5", "$"},
+		{"in default", "${NOTSET:-$$BAR}", "$BAR", "$bar"},
+		{"lone in default", "${NOTSET:-$$}", "$", "$$"},
+		{"no escape", "$BAR $ ${FOO}", "bar $ foo", "bar $ foo"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, noEscape := range []bool{false, true} {
+				expected := test.escaped
+				if noEscape {
+					expected = test.unescaped
+				}
+				result, err := New(test.name, FakeEnv, &Restrictions{NoDollarEscape: noEscape}).Parse(test.input)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if result != expected {
+					t.Errorf("NoDollarEscape=%v Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", noEscape, test.input, result, expected)
+				}
+			}
+		})
+	}
+}
+
+// TestPreprocess tests that the Preprocess hook runs before lexing
+func TestPreprocess(t *testing.T) {
+	vars := regexp.MustCompile(`\$\{?[a-z_]+`)
+	upper := func(s string) string { return vars.ReplaceAllStringFunc(s, strings.ToUpper) }
+
+	parser := New("pre", FakeEnv, &Restrictions{Preprocess: upper})
+	result, err := parser.Parse("$bar ${foo:-x} $$a")
+	if expected := "bar foo $A"; err != nil || result != expected {
+		t.Errorf("expected %q without error, got %q, %v", expected, result, err)
+	}
+
+	crlf := New("crlf", FakeEnv, &Restrictions{Preprocess: func(s string) string {
+		return strings.ReplaceAll(s, "\r\n", "\n")
+	}})
+	if result, err = crlf.Parse("a\r\nb\r\n"); err != nil || result != "a\nb\n" {
+		t.Errorf("expected the fast path to be preprocessed, got %q, %v", result, err)
+	}
+}
+
+// TestPostprocess tests that the Postprocess hook runs on the rendered output
+func TestPostprocess(t *testing.T) {
+	errForbidden := errors.New("output contains FORBIDDEN")
+	reject := func(s string) (string, error) {
+		if strings.Contains(s, "FORBIDDEN") {
+			return "", errForbidden
+		}
+		return strings.ReplaceAll(s, "\t", "  "), nil
+	}
+	testEnv := NewEnv([]string{"OK=fine", "BAD=FORBIDDEN"})
+	parser := New("post", testEnv, &Restrictions{Postprocess: reject, TrailingNewline: NewlineEnsure})
+
+	result, err := parser.Parse("\tvalue: $OK")
+	if expected := "  value: fine\n"; err != nil || result != expected {
+		t.Errorf("expected %q without error, got %q, %v", expected, result, err)
+	}
+	if result, err = parser.Parse("value: ${BAD}"); !errors.Is(err, errForbidden) || result != "" {
+		t.Errorf("expected the postprocess error, got %q, %v", result, err)
+	}
+	if _, err = parser.Parse("value: FORBIDDEN"); !errors.Is(err, errForbidden) {
+		t.Errorf("expected the postprocess error on the fast path, got %v", err)
+	}
+}
+
+// TestOutputFilters tests that the OutputFilters run in order on the rendered output
+func TestOutputFilters(t *testing.T) {
+	errInvalid := errors.New("invalid JSON")
+	validate := func(b []byte) ([]byte, error) {
+		if !json.Valid(b) {
+			return nil, errInvalid
+		}
+		return b, nil
+	}
+	indent := func(b []byte) ([]byte, error) {
+		var out bytes.Buffer
+		err := json.Indent(&out, b, "", "  ")
+		return out.Bytes(), err
+	}
+	upper := func(s string) (string, error) { return strings.ToUpper(s), nil }
+	testEnv := NewEnv([]string{"NAME=web", "PORT=8080"})
+
+	tests := []struct {
+		name, input, expected string
+		r                     *Restrictions
+		err                   error
+	}{
+		{"chained", `{"name":"$NAME","port":$PORT}`, "{\n  \"name\": \"web\",\n  \"port\": 8080\n}",
+			&Restrictions{OutputFilters: []func([]byte) ([]byte, error){validate, indent}}, nil},
+		{"error aborts", `{"port":${NOPE}}`, "",
+			&Restrictions{OutputFilters: []func([]byte) ([]byte, error){validate, indent}}, errInvalid},
+		{"after postprocess", `{"name":"$NAME"}`, "{\n  \"NAME\": \"WEB\"\n}",
+			&Restrictions{Postprocess: upper, OutputFilters: []func([]byte) ([]byte, error){indent}}, nil},
+		{"fast path", `{}`, "{}", &Restrictions{OutputFilters: []func([]byte) ([]byte, error){validate, indent}}, nil},
+		{"fast path error", `{`, "", &Restrictions{OutputFilters: []func([]byte) ([]byte, error){validate, indent}}, errInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, test.r).Parse(test.input)
+			if test.err == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestRequired tests that the Required restriction reports unset and empty variables alike
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		name, input, expected, errMsg string
+	}{
+		{"set variable", "$BAR ${FOO}", "bar foo", ""},
+		{"unset variable", "${NOTSET}", "", "variable ${NOTSET} required but not set"},
+		{"unset bare variable", "$NOTSET", "", "variable ${NOTSET} required but not set"},
+		{"empty variable", "${EMPTY}", "", "variable ${EMPTY} required but empty"},
+		{"default for unset", "${NOTSET:-x}", "x", ""},
+		{"default for empty", "${EMPTY:-x}", "x", ""},
+		{"unset only default keeps empty", "${EMPTY-x}", "", "variable ${EMPTY} required but empty"},
+		{"unset default variable", "${NOTSET:-$ALSO_NOTSET}", "", "variable ${ALSO_NOTSET} required but not set"},
+		{"pattern", "${EMPTY^^}", "", "variable ${EMPTY} required but empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{Required: true}).Parse(test.input)
+			if test.errMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				if err == nil || err.Error() != test.errMsg {
+					t.Fatalf("expected error %q, got %v", test.errMsg, err)
+				}
+				if !errors.Is(err, Error("", "Required")) {
+					t.Errorf("expected Required error, got %v", err)
+				}
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	keep, err := New("keep", FakeEnv, &Restrictions{Required: true, KeepUnset: true}).Parse("${NOTSET}")
+	if err != nil || keep != "${NOTSET}" {
+		t.Errorf("expected KeepUnset to disable Required, got %q, %v", keep, err)
+	}
+}
+
+// TestColonInName tests namespaced lookups such as ${db:host}
+func TestColonInName(t *testing.T) {
+	testEnv := NewEnv([]string{"db:host=db.local", "db=plain", "VAR=v"})
+
+	tests := []struct {
+		name, input, expected string
+		colon, hasErr         bool
+	}{
+		{"namespaced lookup", "${db:host}", "db.local", true, false},
+		{"namespaced default unused", "${db:host:-x}", "db.local", true, false},
+		{"namespaced default used", "${db:port:-5432}", "5432", true, false},
+		{"operator", "${VAR:-x} ${NOTSET:-x}", "v x", true, false},
+		{"alternate", "${db:+set}", "set", true, false},
+		{"bare variable", "$db:host", "plain:host", true, false},
+		{"disabled", "${db:host}", "", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, &Restrictions{ColonInName: test.colon}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestRawDelims(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		delims                [2]string
+		hasErr                bool
+	}{
+		{"raw region", "jq '<<<.[] | $NOTAVAR ${alsonot}>>>' $BAR", "jq '.[] | $NOTAVAR ${alsonot}' bar", [2]string{"<<<", ">>>"}, false},
+		{"escape kept", "<<<$$5>>> $$5", "$$5 $5", [2]string{"<<<", ">>>"}, false},
+		{"several regions", "<<<$A>>>$A<<<$A>>>", "$AAAA$A", [2]string{"<<<", ">>>"}, false},
+		{"no variables", "awk '<<<{print $1}>>>'", "awk '{print $1}'", [2]string{"<<<", ">>>"}, false},
+		{"without sigil", "a<<<b>>>c", "abc", [2]string{"<<<", ">>>"}, false},
+		{"multiline region", "<<<\n$X\n>>>$FOO", "\n$X\nfoo", [2]string{"<<<", ">>>"}, false},
+		{"backticks", "`$NOTAVAR` $FOO", "$NOTAVAR foo", [2]string{"`", "`"}, false},
+		{"unterminated", "<<<$BAR", "", [2]string{"<<<", ">>>"}, true},
+		{"disabled", "<<<$BAR>>>", "<<<bar>>>", [2]string{}, false},
+		{"closing delimiter missing", "<<<$BAR>>>", "<<<bar>>>", [2]string{"<<<", ""}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{RawDelims: test.delims}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestGNUCompat compares with the output of GNU envsubst for HOME=/root, USER=
+// and NOTSET unset.
+func TestGNUCompat(t *testing.T) {
+	env := NewEnv([]string{"HOME=/root", "USER=", "_x=u", "A1=a1"})
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+	}{
+		{"bare and braced", "$HOME ${HOME}/x", "/root /root/x", &Restrictions{}},
+		{"unset and empty", "[$NOTSET][${USER}]", "[][]", &Restrictions{}},
+		{"default kept", "${HOME:-x} ${NOTSET:-x}", "${HOME:-x} ${NOTSET:-x}", &Restrictions{}},
+		{"other operators kept", "${HOME^^} ${HOME#/} ${HOME|upper} ${#HOME}", "${HOME^^} ${HOME#/} ${HOME|upper} ${#HOME}", &Restrictions{}},
+		{"no escape", "$$HOME $$", "$/root $$", &Restrictions{}},
+		{"digits", "$1 ${1} $A1", "$1 ${1} a1", &Restrictions{}},
+		{"underscore", "$_x ${_x}", "u u", &Restrictions{}},
+		{"lone dollar", "cost $ 5 $", "cost $ 5 $", &Restrictions{}},
+		{"unclosed brace", "${HOME", "${HOME", &Restrictions{}},
+		{"empty braces", "${}", "${}", &Restrictions{}},
+		{"non-ASCII name", "$HOMEé", "/rooté", &Restrictions{}},
+		{"shell format", "$HOME $A1", "/root $A1", &Restrictions{VarMatcher: func(v string) bool { return v == "HOME" }}},
+		{"sigil ignored", "$HOME @HOME", "/root @HOME", &Restrictions{Sigil: '@'}},
+		{"keep unset", "$NOTSET ${NOTSET}", "$NOTSET ${NOTSET}", &Restrictions{KeepUnset: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.restrict.GNUCompat = true
+			result, err := New(test.name, env, test.restrict).Parse(test.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	_, err := New("no unset", env, &Restrictions{GNUCompat: true, NoUnset: true}).Parse("${HOME:-x} $NOTSET")
+	if expected := "variable ${NOTSET} not set"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+// TestMaxErrors tests that AllErrors mode stops collecting after MaxErrors
+func TestMaxErrors(t *testing.T) {
+	unset := "$N1 $N2 $N3 $N4 $N5"
+	unterminated := "${N1\n${N2\n${N3\n${N4\n${N5"
+
+	tests := []struct {
+		name     string
+		input    string
+		max      int
+		expected string
+	}{
+		{"limited", unset, 2, "variable ${N1} not set\nvariable ${N2} not set"},
+		{"limit above count", unset, 10, "variable ${N1} not set\nvariable ${N2} not set\nvariable ${N3} not set\nvariable ${N4} not set\nvariable ${N5} not set"},
+		{"unlimited", unset, 0, "variable ${N1} not set\nvariable ${N2} not set\nvariable ${N3} not set\nvariable ${N4} not set\nvariable ${N5} not set"},
+		{"limited syntax errors", unterminated, 2, "closing brace expected\nclosing brace expected"},
+		{"unlimited syntax errors", unterminated, 0, "closing brace expected\nclosing brace expected\nclosing brace expected\nclosing brace expected\nclosing brace expected"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := New(test.name, FakeEnv, &Restrictions{NoUnset: true, MaxErrors: test.max})
+			parser.Mode = AllErrors
+			_, err := parser.Parse(test.input)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if err.Error() != test.expected {
+				t.Errorf("expected error\n\t%q\ngot\n\t%q", test.expected, err.Error())
+			}
+		})
+	}
+
+	parser := New("syntax", FakeEnv, &Restrictions{NoUnset: true, MaxErrors: 1})
+	parser.Mode = AllErrors
+	if _, err := parser.Parse("$N1 ${"); err == nil || err.Error() != "closing brace expected" {
+		t.Errorf("expected only the syntax error, got %v", err)
+	}
+}
+
+// TestAllErrorsRecovery tests that AllErrors mode goes on after a malformed
+// substitution and reports the errors of the rest of the input too
+func TestAllErrorsRecovery(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+	}{
+		{"two unterminated", "${BAR\n${FOO", "closing brace expected\nclosing brace expected"},
+		{"unterminated and bad operator", "$BAR ${FOO:x} ${A", "bad substitution: operator expected after ':'\nclosing brace expected"},
+		{"unterminated then unset", "${BAR\n$NOTSET", "closing brace expected\nvariable ${NOTSET} not set"},
+		{"valid substitutions between", "${BAR} ${FOO\n${A} ${BAR", "closing brace expected\nclosing brace expected"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := New(test.name, FakeEnv, &Restrictions{NoUnset: true})
+			parser.Mode = AllErrors
+			_, err := parser.Parse(test.input)
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("expected error\n\t%q\ngot\n\t%v", test.expected, err)
+			}
+			// Quick mode still stops at the first error
+			parser.Mode = Quick
+			_, err = parser.Parse(test.input)
+			if first, _, _ := strings.Cut(test.expected, "\n"); err == nil || err.Error() != first {
+				t.Errorf("expected quick error\n\t%q\ngot\n\t%v", first, err)
+			}
+		})
+	}
+}
+
+// TestChainDefaults tests flat ${A:-$B:-c} chains of defaults
+func TestChainDefaults(t *testing.T) {
+	testEnv := NewEnv([]string{"A=a", "B=b", "C=c", "EMPTY="})
+
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+		hasErr                bool
+	}{
+		{"first set", "${A:-$B:-x}", "a", &Restrictions{ChainDefaults: true}, false},
+		{"second set", "${NOTSET:-$B:-x}", "b", &Restrictions{ChainDefaults: true}, false},
+		{"literal last", "${NOTSET:-$UNSET2:-x}", "x", &Restrictions{ChainDefaults: true}, false},
+		{"empty skipped", "${EMPTY:-$EMPTY:-$C:-x}", "c", &Restrictions{ChainDefaults: true}, false},
+		{"three variables", "${NOTSET:-$UNSET2:-$UNSET3:-$C}", "c", &Restrictions{ChainDefaults: true}, false},
+		{"variable last unset", "${NOTSET:-$UNSET2:-$UNSET3}", "", &Restrictions{ChainDefaults: true}, false},
+		{"variable last unset NoUnset", "${NOTSET:-$UNSET2:-$UNSET3}", "", &Restrictions{ChainDefaults: true, NoUnset: true}, true},
+		{"skipped unset NoUnset", "${NOTSET:-$UNSET2:-x}", "x", &Restrictions{ChainDefaults: true, NoUnset: true}, false},
+		{"nested substitution", "${NOTSET:-${UNSET2}:-${B^^}:-x}", "B", &Restrictions{ChainDefaults: true}, false},
+		{"nested substitution evaluated once", "${NOTSET:-${B}:-x}", "b", &Restrictions{ChainDefaults: true, MaxSubstitutions: 2}, false},
+		{"nested assignment", "${NOTSET:-${Q:=v}:-x}$Q", "vv", &Restrictions{ChainDefaults: true}, false},
+		{"empty last", "${NOTSET:-$UNSET2:-}", "", &Restrictions{ChainDefaults: true}, false},
+		{"text with separator", "${NOTSET:-x:-$B}", "x:-b", &Restrictions{ChainDefaults: true}, false},
+		{"disabled", "${NOTSET:-x:-$B}", "x:-b", &Restrictions{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, testEnv, test.restrict).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestNoDefaults tests that the NoDefaults restriction rejects every default operator
+func TestNoDefaults(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"plain substitution", "${BAR} $FOO", "bar foo", false},
+		{"case conversion", "${BAR^^}", "BAR", false},
+		{"ternary", "${BAR?y:n}", "y", false},
+		{":-", "${NOTSET:-x}", "", true},
+		{"-", "${NOTSET-x}", "", true},
+		{":=", "${NOTSET:=x}", "", true},
+		{"=", "${NOTSET=x}", "", true},
+		{":+", "${BAR:+x}", "", true},
+		{"+", "${BAR+x}", "", true},
+		{"set variable", "${BAR:-x}", "", true},
+		{"empty default", "${BAR:-}", "", true},
+		{"nested", "${BAR^^} ${X:-${NOTSET:-x}}", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{NoDefaults: true}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if err != nil && !errors.Is(err, Error("", "NoDefaults")) {
+				t.Errorf("expected NoDefaults error, got %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	_, err := New("message", FakeEnv, &Restrictions{NoDefaults: true}).Parse("a: ${PORT:-8080}")
+	if expected := "default value not allowed in ${PORT:-8080}"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestExpandDefaultsOnce(t *testing.T) {
+	env := NewEnv([]string{"B=$C", "C=c", "D=${E}", "E=$C", "SET=set", "PRICE=$$5"})
+	tests := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"default variable", "${A:-$B}", "c", false},
+		{"default nested substitution", "${A:-${B}}", "c", false},
+		{"default text", "${A:-x $B y}", "x c y", false},
+		{"single level only", "${A:-$D}", "$C", false},
+		{"variable not expanded", "$B ${B}", "$C $C", false},
+		{"unused default", "${SET:-$B}", "set", false},
+		{"alternate value", "${SET:+$B}", "c", false},
+		{"escape in value", "${A:-$PRICE}", "$5", false},
+		{"bad reference in value", "${A:-$BAD}", "", true},
+	}
+
+	env.Set("BAD", "${C")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, env, &Restrictions{ExpandDefaultsOnce: true}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	result, err := New("disabled", env, &Restrictions{}).Parse("${A:-$B}")
+	if err != nil || result != "$C" {
+		t.Errorf("expected %q without ExpandDefaultsOnce, got %q, %v", "$C", result, err)
+	}
+}
+
+// TestValuesNotRescanned tests that substituted values are never expanded again
+func TestValuesNotRescanned(t *testing.T) {
+	env := NewEnv([]string{"BAR=${EVIL}", "EVIL=evil", "CMD=$EVIL $(id)", "ESC=$$EVIL", "DEF=${NOTSET:-$EVIL}", "PIPE=${EVIL|pad:9}"})
+	tests := []struct {
+		name, input, expected string
+		r                     *Restrictions
+	}{
+		{"variable", "$BAR", "${EVIL}", &Restrictions{}},
+		{"substitution", "${BAR}", "${EVIL}", &Restrictions{}},
+		{"bare reference", "$CMD", "$EVIL $(id)", &Restrictions{}},
+		{"escape kept", "$ESC", "$$EVIL", &Restrictions{}},
+		{"default operator kept", "$DEF", "${NOTSET:-$EVIL}", &Restrictions{}},
+		{"filter kept", "$PIPE", "${EVIL|pad:9}", &Restrictions{}},
+		{"case conversion", "${BAR,,}", "${evil}", &Restrictions{}},
+		{"used as default", "${NOTSET:-$BAR}", "${EVIL}", &Restrictions{}},
+		{"used as alternate", "${EVIL:+$BAR}", "${EVIL}", &Restrictions{}},
+		{"filter", "${BAR|pad:8}", "${EVIL} ", &Restrictions{}},
+		{"assignment", "${NOTSET:=$BAR} $NOTSET", "${EVIL} ${EVIL}", &Restrictions{}},
+		{"keep unset", "$BAR $NOTSET", "${EVIL} $NOTSET", &Restrictions{KeepUnset: true}},
+		{"no unset", "$DEF", "${NOTSET:-$EVIL}", &Restrictions{NoUnset: true}},
+		{"chained defaults", "${NOTSET:-$NONE:-$BAR}", "${EVIL}", &Restrictions{ChainDefaults: true}},
+		{"gnu", "$BAR", "${EVIL}", &Restrictions{GNUCompat: true}},
+		{"expand defaults once", "${NOTSET:-$BAR} $BAR", "evil ${EVIL}", &Restrictions{ExpandDefaultsOnce: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, env, test.r).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}
+
+// TestMaxNameLength tests that names longer than MaxNameLength are kept as text, or rejected under StrictNameLength
+func TestMaxNameLength(t *testing.T) {
+	env := NewEnv([]string{"ABCD=abcd", "ABCDE=abcde", "ÄÖÜß=umlauts"})
+	tests := []struct {
+		name, input, expected string
+		strict, hasErr        bool
+	}{
+		{"at the limit", "$ABCD ${ABCD}", "abcd abcd", false, false},
+		{"over the limit", "$ABCDE", "$ABCDE", false, false},
+		{"over the limit in braces", "${ABCDE}", "${ABCDE}", false, false},
+		{"over the limit with operator", "${ABCDE:-x}", "${ABCDE:-x}", false, false},
+		{"over the limit in default", "${N:-$ABCDE}", "$ABCDE", false, false},
+		{"nested at the limit", "${N:-${ABCD}}", "abcd", false, false},
+		{"runes are counted", "$ÄÖÜß", "umlauts", false, false},
+		{"pathological name", "$" + strings.Repeat("A", 10000) + " $ABCD", "$" + strings.Repeat("A", 10000) + " abcd", false, false},
+		{"strict at the limit", "$ABCD", "abcd", true, false},
+		{"strict over the limit", "$ABCDE", "", true, true},
+		{"strict over the limit in braces", "${ABCDE}", "", true, true},
+		{"strict over the limit in default", "${N:-$ABCDE}", "", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Restrictions{MaxNameLength: 4, StrictNameLength: test.strict}
+			result, err := New(test.name, env, r).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	for _, strict := range []bool{false, true} {
+		r := &Restrictions{GNUCompat: true, MaxNameLength: 4, StrictNameLength: strict}
+		result, err := New("gnu", env, r).Parse("$ABCD ${ABCDE}")
+		if strict && err == nil {
+			t.Errorf("expected an error for a long name under GNUCompat, got %q", result)
+		}
+		if !strict && (err != nil || result != "abcd ${ABCDE}") {
+			t.Errorf("expected %q under GNUCompat, got %q, %v", "abcd ${ABCDE}", result, err)
+		}
+	}
+
+	_, err := New("error", env, &Restrictions{MaxNameLength: 4, StrictNameLength: true}).Parse("x ${ABCDE}")
+	if err == nil || !strings.Contains(err.Error(), "variable name longer than 4 characters") {
+		t.Errorf("expected a name length error, got %v", err)
+	}
+}
+
+// TestMaxSubstitutions tests that MaxSubstitutions bounds the evaluations of a single Parse
+func TestMaxSubstitutions(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		hasErr                bool
+	}{
+		{"below limit", "$A", "AAA", false},
+		{"at limit", "$A ${BAR}", "AAA bar", false},
+		{"above limit", "$A ${BAR} $FOO", "", true},
+		{"nested default counts", "$A ${NOTSET:-${FOO}}", "", true},
+		{"variable in default text counts", "${NOTSET:-x $FOO} $A", "", true},
+		{"unused default not counted", "${BAR:-${FOO}} $A", "bar AAA", false},
+		{"escapes not counted", "$$A $$B $$C $A", "$A $B $C AAA", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, &Restrictions{MaxSubstitutions: 2}).Parse(test.input)
+			if hasErr := err != nil; hasErr != test.hasErr {
+				t.Fatalf("Error expectation mismatch: got error=%v, expected error=%v\nInput: %s\nError: %v",
+					hasErr, test.hasErr, test.input, err)
+			}
+			if err != nil && !errors.Is(err, Error("", "MaxSubstitutions")) {
+				t.Errorf("expected MaxSubstitutions error, got %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+
+	// the count starts over with every parse
+	parser := New("reuse", FakeEnv, &Restrictions{MaxSubstitutions: 2})
+	for i := 0; i < 3; i++ {
+		if result, err := parser.Parse("$A $BAR"); err != nil || result != "AAA bar" {
+			t.Fatalf("parse %d: expected %q without error, got %q, %v", i, "AAA bar", result, err)
+		}
+	}
+	if _, exps, err := parser.Explain("$A $BAR"); err != nil || len(exps) != 2 {
+		t.Errorf("expected Explain to succeed at the limit, got %v, %v", exps, err)
+	}
+}
+
+// TestNormalizeUnset tests that unset bare variables are kept in braces
+func TestNormalizeUnset(t *testing.T) {
+	tests := []struct {
+		name, input, expected string
+		restrict              *Restrictions
+	}{
+		{"bare unset", "$NOTSET", "${NOTSET}", &Restrictions{NormalizeUnset: true}},
+		{"braced unset", "${NOTSET}", "${NOTSET}", &Restrictions{NormalizeUnset: true}},
+		{"mixed", "$BAR:$NOTSET ${FOO}/${NOTSET2}", "bar:${NOTSET} foo/${NOTSET2}", &Restrictions{NormalizeUnset: true}},
+		{"adjacent text", "$NOTSET.txt", "${NOTSET}.txt", &Restrictions{NormalizeUnset: true}},
+		{"default applies", "${NOTSET:-x}", "x", &Restrictions{NormalizeUnset: true}},
+		{"unset variable default", "${NOTSET:-$NOTSET2}", "${NOTSET2}", &Restrictions{NormalizeUnset: true}},
+		{"unset variable in default text", "${NOTSET:-a $NOTSET2}", "a ${NOTSET2}", &Restrictions{NormalizeUnset: true}},
+		{"pattern kept as is", "${NOTSET^^}", "${NOTSET^^}", &Restrictions{NormalizeUnset: true}},
+		{"escape kept", "$$NOTSET", "$NOTSET", &Restrictions{NormalizeUnset: true}},
+		{"overrides NoUnset", "$NOTSET", "${NOTSET}", &Restrictions{NormalizeUnset: true, NoUnset: true}},
+		{"custom sigil", "@NOTSET @BAR", "@{NOTSET} bar", &Restrictions{NormalizeUnset: true, Sigil: '@'}},
+		{"empty substituted", "[$EMPTY] [${EMPTY}] $NOTSET", "[] [] ${NOTSET}", &Restrictions{NormalizeUnset: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := New(test.name, FakeEnv, test.restrict).Parse(test.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != test.expected {
+				t.Errorf("Result mismatch:\nInput:    %q\nGot:      %q\nExpected: %q", test.input, result, test.expected)
+			}
+		})
+	}
+}